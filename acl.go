@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"sync"
+)
+
+// ACL is the access control list of methods. A method may be called by the
+// peers of the names or roles allowed for it. The rule of method "*" is of
+// the methods without their own rules, which may not be called by anyone if
+// there isn't. The identity "*" is anyone, even a peer not authenticated.
+//
+// It's safe to change the rules while serving. The callbacks registered by
+// the Client of a connection are always allowed.
+type ACL struct {
+	lock  sync.RWMutex
+	rules map[string]map[string]bool // identities by method
+}
+
+func NewACL() *ACL {
+	a := new(ACL)
+	a.rules = make(map[string]map[string]bool)
+	return a
+}
+
+// Allow the identities to call method, besides the ones allowed already.
+func (a *ACL) Allow(method string, identities ...string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.rules[method] == nil {
+		a.rules[method] = make(map[string]bool)
+	}
+	for _, id := range identities {
+		a.rules[method][id] = true
+	}
+}
+
+// Replace all rules by the identities of methods.
+func (a *ACL) Load(rules map[string][]string) {
+	loaded := make(map[string]map[string]bool)
+	for method, identities := range rules {
+		loaded[method] = make(map[string]bool)
+		for _, id := range identities {
+			loaded[method][id] = true
+		}
+	}
+
+	a.lock.Lock()
+	a.rules = loaded
+	a.lock.Unlock()
+}
+
+// Whether peer may call method.
+func (a *ACL) Allowed(peer *Peer, method string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	ids, ok := a.rules[method]
+	if !ok {
+		ids, ok = a.rules["*"]
+	}
+	if !ok {
+		return false
+	}
+	if ids["*"] {
+		return true
+	}
+	if peer == nil {
+		return false
+	}
+
+	if ids[peer.Name] {
+		return true
+	}
+	for _, role := range peer.Roles {
+		if ids[role] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,270 @@
+package rpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Time limit of the handshake on a net.Conn.
+const handshakeTimeout = time.Second * 10
+
+// Limit of a handshake frame.
+const maxFrameSize = 64 << 10
+
+// Peer is the identity of the other side of a connection.
+type Peer struct {
+	Name  string            // e.g. the owner of a token, or the common name of the certificate
+	Roles []string          // for ACL, by the authenticator
+	Info  map[string]string // more about the peer, by the authenticator
+
+	Certificate *x509.Certificate // verified by TLS, or nil
+}
+
+// Authenticator runs a handshake on a new connection before any request,
+// on both sides. The server side returns the peer it has authenticated, or
+// an error to reject the connection. The client side may return nil.
+type Authenticator interface {
+	Authenticate(conn io.ReadWriter, server bool) (*Peer, error)
+}
+
+type peerKey struct{}
+
+// The peer of the connection of the request handled with ctx, or nil if
+// it's not authenticated.
+func PeerFromContext(ctx context.Context) *Peer {
+	p, _ := ctx.Value(peerKey{}).(*Peer)
+	return p
+}
+
+// Dial and authenticate by auth.
+func DialAuth(network, address string, auth Authenticator) (*Rpc, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewRpcAuth(conn, auth, false)
+}
+
+// Accept a connection and authenticate the peer by auth.
+func AcceptAuth(l net.Listener, auth Authenticator) (*Rpc, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewRpcAuth(conn, auth, true)
+}
+
+// Run the handshake of auth on conn, then serve it if it succeeds, or close
+// it if it fails. If conn is a *tls.Conn, the TLS handshake runs first. auth
+// may be nil if there's only TLS.
+func NewRpcAuth(conn io.ReadWriteCloser, auth Authenticator, server bool) (*Rpc, error) {
+	return NewRpcAuthWithCodec(conn, NewJsonCodec, auth, server)
+}
+
+// Same as NewRpcAuth, but serve conn by the codec of newCodec, e.g.
+// NewGobCodec, after the handshake.
+func NewRpcAuthWithCodec(conn io.ReadWriteCloser, newCodec func(conn io.ReadWriteCloser) Codec, auth Authenticator, server bool) (*Rpc, error) {
+	peer, err := handshake(conn, auth, server)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newRpc(newCodec(conn), nil)
+	if peer != nil {
+		r.setPeer(peer)
+	}
+	go r.run()
+	return r, nil
+}
+
+// Run the handshake of TLS if conn is a *tls.Conn, then the one of auth if
+// it's not nil, and close conn if it fails. The peer is the one of auth with
+// the certificate of TLS.
+func handshake(conn io.ReadWriteCloser, auth Authenticator, server bool) (*Peer, error) {
+	if nc, ok := conn.(net.Conn); ok {
+		nc.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer nc.SetDeadline(time.Time{})
+	}
+
+	var peer *Peer
+	if tc, ok := conn.(*tls.Conn); ok {
+		err := tc.Handshake()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		peer = tlsPeer(tc.ConnectionState())
+	}
+
+	if auth != nil {
+		p, err := auth.Authenticate(conn, server)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if p != nil && peer != nil {
+			p.Certificate = peer.Certificate
+		}
+		if p != nil {
+			peer = p
+		}
+	}
+	return peer, nil
+}
+
+///////////////////////////////////////////////////////////
+
+// TokenAuth authenticates the client by a token. The client sends Token, and
+// the server finds the name of the peer of it in Tokens.
+type TokenAuth struct {
+	Token  string            // of the client
+	Tokens map[string]string // names by token, on the server
+}
+
+func (a *TokenAuth) Authenticate(conn io.ReadWriter, server bool) (*Peer, error) {
+	if !server {
+		err := writeFrame(conn, []byte(a.Token))
+		if err != nil {
+			return nil, err
+		}
+		return nil, readResult(conn)
+	}
+
+	token, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var peer *Peer
+	for t, name := range a.Tokens { // compare all in constant time
+		if subtle.ConstantTimeCompare([]byte(t), token) == 1 {
+			peer = &Peer{Name: name}
+		}
+	}
+	return peer, writeResult(conn, peer != nil)
+}
+
+// HMACAuth authenticates the client by the HMAC-SHA256 of a random challenge
+// of the server, keyed by a secret that's never sent.
+type HMACAuth struct {
+	Name   string // of the client
+	Secret []byte // of the client
+
+	Secrets map[string][]byte // secrets by name, on the server
+}
+
+func (a *HMACAuth) Authenticate(conn io.ReadWriter, server bool) (*Peer, error) {
+	if !server {
+		challenge, err := readFrame(conn)
+		if err != nil {
+			return nil, err
+		}
+		err = writeFrame(conn, []byte(a.Name))
+		if err != nil {
+			return nil, err
+		}
+		err = writeFrame(conn, hmacSum(a.Secret, challenge))
+		if err != nil {
+			return nil, err
+		}
+		return nil, readResult(conn)
+	}
+
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	err = writeFrame(conn, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := readFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, ok := a.Secrets[string(name)]
+	ok = ok && hmac.Equal(sum, hmacSum(secret, challenge))
+
+	var peer *Peer
+	if ok {
+		peer = &Peer{Name: string(name)}
+	}
+	return peer, writeResult(conn, ok)
+}
+
+func hmacSum(secret, challenge []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(challenge)
+	return h.Sum(nil)
+}
+
+// The server tells the client whether it's accepted, and fails if it's not.
+func writeResult(w io.Writer, ok bool) error {
+	result := "denied"
+	if ok {
+		result = "ok"
+	}
+	err := writeFrame(w, []byte(result))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+func readResult(r io.Reader) error {
+	result, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if string(result) != "ok" {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// A frame of the handshake is prefixed by its length in 4 bytes.
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > maxFrameSize {
+		return fmt.Errorf("handshake frame too large: %v", len(b))
+	}
+	buf := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(buf, uint32(len(b)))
+	copy(buf[4:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [4]byte
+	_, err := io.ReadFull(r, head[:])
+	if err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(head[:])
+	if n > maxFrameSize {
+		return nil, fmt.Errorf("handshake frame too large: %v", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
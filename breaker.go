@@ -0,0 +1,213 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// State of the circuit of a method.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls go through
+	BreakerOpen                         // calls fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     // a few calls go through to try
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerPolicy is when the circuit of a method opens and closes. The fields
+// not set take the ones of DefaultBreakerPolicy.
+type BreakerPolicy struct {
+	Failures int           // in a row to open the circuit
+	OpenTime time.Duration // before it's half-open
+	Trials   int           // calls to succeed while half-open to close it, any failure opens it again
+	Failed   []error       // errors counted as failures, an *Error matches the ones of its code
+}
+
+// It counts the handlers that panic as well, which are replied CodeInternalError.
+var DefaultBreakerPolicy = BreakerPolicy{
+	Failures: 5,
+	OpenTime: time.Second * 5,
+	Trials:   1,
+	Failed:   []error{ErrTimeout, ErrDisconnected, ErrInternalError},
+}
+
+// Breaker is a circuit breaker of each method, so that the calls fail fast
+// while the remote is unhealthy. Use Intercept as a ClientInterceptor:
+//
+//	b := NewBreaker(DefaultBreakerPolicy)
+//	client.Use(b.Intercept)
+//
+// Errors other than the failures, such as the ones of the handlers, count as
+// successes. A canceled call counts as neither.
+type Breaker struct {
+	policy   BreakerPolicy
+	onChange func(method string, state BreakerState, err error)
+
+	lock     sync.Mutex
+	circuits map[string]*circuit // by method
+}
+
+// The circuit of a method.
+type circuit struct {
+	state    BreakerState
+	gen      int // incremented on each change, to ignore the calls of an old state
+	failures int // in a row, while closed
+	opened   time.Time
+	trials   int // calls started while half-open
+	passed   int // calls succeeded while half-open
+}
+
+func NewBreaker(policy BreakerPolicy) *Breaker {
+	if policy.Failures <= 0 {
+		policy.Failures = DefaultBreakerPolicy.Failures
+	}
+	if policy.OpenTime <= 0 {
+		policy.OpenTime = DefaultBreakerPolicy.OpenTime
+	}
+	if policy.Trials <= 0 {
+		policy.Trials = DefaultBreakerPolicy.Trials
+	}
+	if policy.Failed == nil {
+		policy.Failed = DefaultBreakerPolicy.Failed
+	}
+
+	b := new(Breaker)
+	b.policy = policy
+	b.circuits = make(map[string]*circuit)
+	return b
+}
+
+// Called on every change of the state of a method, with the error that
+// caused it if any. It's called with the breaker locked, so it shouldn't
+// block or call the breaker.
+func (b *Breaker) OnStateChange(f func(method string, state BreakerState, err error)) {
+	b.onChange = f
+}
+
+// The state of method.
+func (b *Breaker) State(method string) BreakerState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuit(method)
+	b.refresh(method, c, time.Now())
+	return c.state
+}
+
+// Fail the call with ErrCircuitOpen without calling next if the circuit of
+// method is open, or call next and count its error.
+func (b *Breaker) Intercept(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error {
+	gen, err := b.allow(method)
+	if err != nil {
+		return err
+	}
+	err = next(ctx, method, params, result)
+	b.done(method, gen, err)
+	return err
+}
+
+func (b *Breaker) allow(method string) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuit(method)
+	b.refresh(method, c, time.Now())
+
+	switch c.state {
+	case BreakerOpen:
+		return 0, ErrCircuitOpen
+	case BreakerHalfOpen:
+		if c.trials >= b.policy.Trials {
+			return 0, ErrCircuitOpen
+		}
+		c.trials++
+	}
+	return c.gen, nil
+}
+
+func (b *Breaker) done(method string, gen int, err error) {
+	if err == context.Canceled { // not counted
+		b.cancelTrial(method, gen)
+		return
+	}
+	failed := matchError(b.policy.Failed, err)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuit(method)
+	if c.gen != gen {
+		return
+	}
+
+	switch c.state {
+	case BreakerClosed:
+		if !failed {
+			c.failures = 0
+			return
+		}
+		c.failures++
+		if c.failures >= b.policy.Failures {
+			b.setState(method, c, BreakerOpen, err)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			b.setState(method, c, BreakerOpen, err)
+			return
+		}
+		c.passed++
+		if c.passed >= b.policy.Trials {
+			b.setState(method, c, BreakerClosed, nil)
+		}
+	}
+}
+
+// Give back the place of a trial call that's canceled.
+func (b *Breaker) cancelTrial(method string, gen int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	c := b.circuit(method)
+	if c.gen == gen && c.state == BreakerHalfOpen {
+		c.trials--
+	}
+}
+
+func (b *Breaker) circuit(method string) *circuit {
+	c, ok := b.circuits[method]
+	if !ok {
+		c = new(circuit)
+		b.circuits[method] = c
+	}
+	return c
+}
+
+// Half-open the circuit if it's been open for long enough.
+func (b *Breaker) refresh(method string, c *circuit, now time.Time) {
+	if c.state == BreakerOpen && now.Sub(c.opened) >= b.policy.OpenTime {
+		b.setState(method, c, BreakerHalfOpen, nil)
+	}
+}
+
+func (b *Breaker) setState(method string, c *circuit, state BreakerState, err error) {
+	c.state = state
+	c.gen++
+	c.failures = 0
+	c.trials = 0
+	c.passed = 0
+	if state == BreakerOpen {
+		c.opened = time.Now()
+	}
+	if b.onChange != nil {
+		b.onChange(method, state, err)
+	}
+}
@@ -0,0 +1,73 @@
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+)
+
+// Callbacks are registered on the Server of the caller by these names.
+const callbackPrefix = "$callback."
+
+// Replace the func params by references to callbacks, which are served by the
+// Server of the same Rpc until release is called. A nil func is sent as nil.
+func (c *Client) proxyFuncs(params []interface{}) (proxied []interface{}, release func(), err error) {
+	var names []string
+	release = func() {
+		for _, name := range names {
+			c.server.unregisterCallback(name)
+		}
+	}
+
+	for i, param := range params {
+		if param == nil || reflect.TypeOf(param).Kind() != reflect.Func {
+			continue
+		}
+
+		if c.server == nil {
+			return nil, nil, fmt.Errorf("callback needs a Server")
+		}
+
+		if proxied == nil {
+			proxied = make([]interface{}, len(params))
+			copy(proxied, params)
+		}
+		if reflect.ValueOf(param).IsNil() {
+			proxied[i] = nil
+			continue
+		}
+
+		name := fmt.Sprintf("%s%d", callbackPrefix, atomic.AddInt64(&c.cbid, 1))
+		err = c.server.registerCallback(name, param)
+		if err != nil {
+			release()
+			return nil, nil, fmt.Errorf("callback: %v", err.Error())
+		}
+		names = append(names, name)
+
+		proxied[i] = name // the reference on the wire
+	}
+
+	if proxied == nil { // no func
+		return params, nil, nil
+	}
+	return proxied, release, nil
+}
+
+// Make a func of type t that calls back the caller by the reference.
+func (s *Server) makeCallback(t reflect.Type, name string) (reflect.Value, error) {
+	if s.client == nil {
+		return reflect.Value{}, fmt.Errorf("callback needs a Client")
+	}
+	if !strings.HasPrefix(name, callbackPrefix) {
+		return reflect.Value{}, fmt.Errorf("invalid callback %v", name)
+	}
+
+	pf := reflect.New(t)
+	err := s.client.MakeFunc(name, pf.Interface())
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return pf.Elem(), nil
+}
@@ -1,8 +1,13 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -11,21 +16,676 @@ import (
 type Client struct {
 	codec   Codec
 	reqid   int64
-	reqMap  map[int64]chan *Response
+	reqMap  map[int64]*Call
 	lock    sync.RWMutex
 	timeout time.Duration
+	closed  bool
+
+	shutdown bool
+	pending  sync.WaitGroup // of the calls in reqMap
+
+	server *Server // of the same Rpc, to serve callbacks
+	cbid   int64
+
+	interceptors []ClientInterceptor
+	header       Header // sent with all calls
+
+	retry      RetryPolicy
+	idempotent methodSet
+}
+
+// Invoker makes a remote call, like Client.CallRemoteContext.
+type Invoker func(ctx context.Context, method string, params []interface{}, result interface{}) error
+
+// ClientInterceptor wraps remote calls. It may change the method, params or
+// ctx before calling next, call next more than once to retry, or return
+// without calling it to fail the call.
+type ClientInterceptor func(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error
+
+// Call is an active or finished remote call.
+type Call struct {
+	Method  string
+	Params  []interface{}
+	Result  interface{} // pointer to decode the result into, or nil
+	Header  Header      // sent with the request
+	Trailer Header      // set by the handler, after completion
+	Error   error       // after completion
+	Done    chan *Call  // receives the call itself when it completes
+
+	id      int64
+	notify  bool
+	stream  *Stream // if the call streams items
+	release func()  // callbacks in params
+}
+
+func (call *Call) done() {
+	if call.release != nil {
+		call.release()
+		call.release = nil
+	}
+
+	select {
+	case call.Done <- call:
+	default:
+		// never block the read loop. the channel should have enough buffer.
+		log.Println("rpc: discarding the completion of call", call.Method, "due to insufficient Done chan capacity")
+	}
 }
 
 func newClientWithCodec(codec Codec) *Client {
 	c := new(Client)
 	c.codec = codec
 	c.reqid = 0
-	c.reqMap = make(map[int64]chan *Response)
+	c.reqMap = make(map[int64]*Call)
 	c.timeout = time.Second * 5
+	c.retry = DefaultRetryPolicy
 	return c
 }
 
+// Make all func fields of *client call the remote methods of the same names.
+// A field may be tagged with options separated by commas, like
+// `rpc:"name=Svc.Echo,timeout=2s,retry=3"`:
+//
+//	name=Svc.Echo  call the remote method Svc.Echo instead
+//	timeout=2s     the timeout of each try instead of the client timeout
+//	idempotent     call again by the retry policy if the call fails, like
+//	               the methods marked by MarkIdempotent
+//	retry=3        idempotent, but call again at most 3 times
+//	notify         send a notification, and return no result
+//
+// It fails if a tag is malformed.
 func (c *Client) MakeClient(client interface{}) error {
+	return makeClient(client, c.makeFunc)
+}
+
+// Make *fptr a func that calls the remote method. If the first param of the
+// func is a context.Context, it's used for the call but not sent.
+func (c *Client) MakeFunc(method string, fptr interface{}) (err error) {
+	return c.makeFunc(fptr, funcOptions{name: method})
+}
+
+// Make *fptr a func that sends notifications of the remote method.
+// The func must return an error only.
+func (c *Client) MakeNotify(method string, fptr interface{}) (err error) {
+	return c.makeFunc(fptr, funcOptions{name: method, notify: true})
+}
+
+func (c *Client) makeFunc(fptr interface{}, opts funcOptions) error {
+	v, err := makeFunc(c, fptr, opts)
+	if err != nil {
+		return err
+	}
+
+	// register type
+	return codecRegisterFuncTypes(c.codec, v.Interface())
+}
+
+// Add interceptors of the calls, including the ones of the funcs made by
+// MakeFunc. Notifications, streams, the calls of Go and the ones of a Batch
+// are not intercepted. They're called in the order added, the first one is
+// the outermost, within the client timeout.
+func (c *Client) Use(interceptors ...ClientInterceptor) {
+	c.lock.Lock()
+	c.interceptors = append(c.interceptors, interceptors...)
+	c.lock.Unlock()
+}
+
+// Set a header sent with all calls and notifications. The headers of the
+// context of a call take the place of the ones of the same keys.
+func (c *Client) SetHeader(key, value string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	h := make(Header, len(c.header)+1) // copy on write
+	for k, v := range c.header {
+		h[k] = v
+	}
+	h[key] = value
+	c.header = h
+}
+
+// The default headers merged with the ones of ctx.
+func (c *Client) headerOf(ctx context.Context) Header {
+	c.lock.RLock()
+	defaults := c.header
+	c.lock.RUnlock()
+	return mergeHeader(defaults, ctx)
+}
+
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+func (c *Client) CallRemote(method string, params []interface{}, result interface{}) error {
+	return c.CallRemoteContext(context.Background(), method, params, result)
+}
+
+// Call a remote method and wait for the result until ctx is done.
+// The deadline of ctx takes the place of the client timeout, which is only
+// applied when ctx has no deadline. ErrTimeout is returned if the deadline
+// exceeded, or ctx.Err() if ctx is canceled. In both cases the call is
+// canceled on the server as well.
+//
+// A call of an idempotent method is called again by the retry policy if it
+// fails, within the same deadline.
+func (c *Client) CallRemoteContext(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	return c.invoke(ctx, funcOptions{name: method}, params, result)
+}
+
+// Set the retry policy of idempotent methods. It's DefaultRetryPolicy by
+// default.
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retry = policy
+}
+
+// Mark the methods idempotent, which are safe to call again by the retry
+// policy if they fail.
+func (c *Client) MarkIdempotent(methods ...string) {
+	c.idempotent.add(methods...)
+}
+
+func (c *Client) invoke(ctx context.Context, opts funcOptions, params []interface{}, result interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 && opts.timeout <= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	c.lock.RLock()
+	invoker := intercept(c.callRemote, c.interceptors)
+	c.lock.RUnlock()
+
+	return c.retry.call(ctx, opts.attempts(&c.retry, &c.idempotent), opts.timeout, func(ctx context.Context) error {
+		return invoker(ctx, opts.name, params, result)
+	})
+}
+
+func (c *Client) callRemote(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	call := c.goCall(ctx, method, params, result, make(chan *Call, 1), nil)
+
+	select {
+	case <-call.Done:
+		receiveTrailer(ctx, call)
+		return call.Error
+	case <-ctx.Done():
+		if !c.abort(call) { // completed meanwhile
+			<-call.Done
+			receiveTrailer(ctx, call)
+			return call.Error
+		}
+
+		call.Error = ctx.Err()
+		if call.Error == context.DeadlineExceeded {
+			call.Error = ErrTimeout
+		}
+		call.done()
+		return call.Error
+	}
+}
+
+// Call a remote method asynchronously. The call is sent to done once it
+// completes. If done is nil, a new channel is allocated. done must have
+// enough buffer for the calls sharing it, a call that doesn't fit is dropped
+// and logged. No timeout is
+// applied, use Abort to give up a call. Only the default headers are sent.
+// It's not intercepted by the interceptors of Use.
+//
+// A func in params is served as a callback to the remote handler until the
+// call completes.
+func (c *Client) Go(method string, params []interface{}, result interface{}, done chan *Call) *Call {
+	return c.goCall(context.Background(), method, params, result, done, nil)
+}
+
+// The headers and the deadline of ctx are sent with the request.
+func (c *Client) goCall(ctx context.Context, method string, params []interface{}, result interface{}, done chan *Call, st *Stream) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("rpc: done channel is unbuffered")
+	}
+
+	header := c.headerOf(ctx)
+	call := &Call{Method: method, Params: params, Result: result, Header: header, Done: done, stream: st}
+
+	codec := c.codec
+	if codec == nil {
+		call.Error = ErrDisconnected
+		call.done()
+		return call
+	}
+
+	if result != nil && reflect.TypeOf(result).Kind() != reflect.Ptr {
+		call.Error = fmt.Errorf("result must be a pointer")
+		call.done()
+		return call
+	}
+
+	if st == nil {
+		var err error
+		params, call.release, err = c.proxyFuncs(params)
+		if err != nil {
+			call.Error = err
+			call.done()
+			return call
+		}
+	}
+
+	timeout, err := timeoutOf(ctx)
+	if err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+
+	if err := c.register(call); err != nil {
+		call.Error = err
+		call.done()
+		return call
+	}
+
+	err = codec.WriteRequest(&Request{Id: call.id, Method: method, Header: header, Timeout: timeout, params: params})
+
+	if err != nil && c.unregister(call) {
+		call.Error = err
+		call.done()
+	}
+
+	return call
+}
+
+// Give the call an id and wait for its response.
+func (c *Client) register(call *Call) error {
+	call.id = atomic.AddInt64(&c.reqid, 1)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return ErrDisconnected
+	}
+	if c.shutdown {
+		return ErrShuttingDown
+	}
+	c.reqMap[call.id] = call
+	c.pending.Add(1)
+	return nil
+}
+
+// Whether the call is still pending until now.
+func (c *Client) unregister(call *Call) bool {
+	_, ok := c.remove(call.id)
+	return ok
+}
+
+func (c *Client) remove(id int64) (*Call, bool) {
+	c.lock.Lock()
+	call, ok := c.reqMap[id]
+	if ok {
+		delete(c.reqMap, id)
+		c.pending.Done()
+	}
+	c.lock.Unlock()
+	return call, ok
+}
+
+// Give up a pending call, which is canceled on the server as well.
+// The call completes with ErrCanceled, unless it's already done.
+func (c *Client) Abort(call *Call) {
+	if c.abort(call) {
+		call.Error = ErrCanceled
+		call.done()
+	}
+}
+
+func (c *Client) abort(call *Call) bool {
+	if !c.unregister(call) {
+		return false
+	}
+
+	// tell the server to stop working on it
+	if codec := c.codec; codec != nil {
+		codec.WriteRequest(&Request{Id: call.id, kind: kindCancel})
+	}
+
+	if call.stream != nil {
+		call.Error = ErrCanceled
+		c.finishStream(call, nil)
+	}
+	return true
+}
+
+// Send a notification of the remote method. No reply is expected, so it
+// returns once the request is written.
+func (c *Client) Notify(method string, params []interface{}) error {
+	codec := c.codec
+	if codec == nil {
+		return ErrDisconnected
+	}
+
+	c.lock.RLock()
+	closed, shutdown := c.closed, c.shutdown
+	c.lock.RUnlock()
+	if closed {
+		return ErrDisconnected
+	}
+	if shutdown {
+		return ErrShuttingDown
+	}
+
+	return codec.WriteRequest(&Request{Id: 0, Method: method, Header: c.headerOf(context.Background()), params: params})
+}
+
+func (c *Client) onResponse(resp *Response) error {
+	if resp.kind == kindBatch {
+		for _, r := range resp.batch {
+			c.onResponse(r)
+		}
+		return nil
+	}
+
+	switch resp.kind {
+	case kindOpen, kindItem, kindAckSend:
+		c.lock.RLock()
+		call, ok := c.reqMap[resp.Id]
+		c.lock.RUnlock()
+
+		if ok && call.stream != nil {
+			c.onStream(call, resp)
+		}
+		return nil
+	}
+
+	call, ok := c.remove(resp.Id)
+	if !ok { // TODO error
+		return nil
+	}
+
+	call.Trailer = resp.Header
+	if resp.Error != nil {
+		call.Error = resp.Error
+	} else if call.Result != nil {
+		call.Error = resp.Result(call.Result)
+	}
+
+	if call.stream != nil {
+		c.finishStream(call, resp)
+		return nil
+	}
+	call.done()
+
+	return nil
+}
+
+// Frames of the stream from the handler.
+func (c *Client) onStream(call *Call, resp *Response) {
+	st := call.stream
+	switch resp.kind {
+	case kindOpen:
+		st.open()
+		call.done()
+	case kindItem:
+		st.push(resp.result)
+	case kindAckSend:
+		var n int
+		if resp.Result(&n) == nil {
+			st.addCredits(n)
+		}
+	}
+}
+
+// The stream call is over, resp is nil if it's failed locally.
+func (c *Client) finishStream(call *Call, resp *Response) {
+	call.stream.finish(resp)
+	if !call.stream.isOpened() {
+		call.done()
+	}
+}
+
+// Start a batch of calls, which are sent in one frame.
+func (c *Client) Batch() *Batch {
+	return &Batch{client: c}
+}
+
+// Refuse new calls, and wait for the pending calls to complete.
+func (c *Client) drain(ctx context.Context) error {
+	c.lock.Lock()
+	c.shutdown = true
+	c.lock.Unlock()
+
+	return waitContext(ctx, &c.pending)
+}
+
+// Fail all pending calls with ErrDisconnected, and calls after.
+func (c *Client) close() {
+	c.lock.Lock()
+	c.closed = true
+	calls := c.reqMap
+	c.reqMap = make(map[int64]*Call)
+	for range calls {
+		c.pending.Done()
+	}
+	c.lock.Unlock()
+
+	for _, call := range calls {
+		call.Error = ErrDisconnected
+		if call.stream != nil {
+			c.finishStream(call, nil)
+			continue
+		}
+		call.done()
+	}
+}
+
+// Open a stream of the remote method, whose handler takes a *Stream.
+func (c *Client) OpenStream(method string) (*Stream, error) {
+	return c.OpenStreamContext(context.Background(), method, nil)
+}
+
+// Open a stream of the remote method with params. It returns once the
+// handler is called. The stream is canceled if ctx is done. The client
+// timeout only applies to opening.
+func (c *Client) OpenStreamContext(ctx context.Context, method string, params []interface{}) (*Stream, error) {
+	st := newStream(ctx, c.codec, 0)
+	call := c.goCall(ctx, method, params, nil, make(chan *Call, 1), st)
+	st.id = call.id
+	st.call = call
+
+	openCtx := ctx
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		openCtx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	select {
+	case <-call.Done:
+	case <-openCtx.Done():
+		if c.abort(call) {
+			err := openCtx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			return nil, err
+		}
+		<-call.Done
+	}
+
+	if !st.isOpened() {
+		if call.Error != nil {
+			return nil, call.Error
+		}
+		return nil, ErrStreamClosed
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.abort(call)
+			case <-st.done:
+			}
+		}()
+	}
+
+	return st, nil
+}
+
+// Call a remote method that streams items back. It returns a channel of the
+// items once the stream is opened, which is closed when the stream ends, or
+// ctx is done.
+func (c *Client) callStream(ctx context.Context, method string, params []interface{}, elemType reflect.Type) (reflect.Value, error) {
+	out := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elemType), 0)
+
+	st, err := c.OpenStreamContext(ctx, method, params)
+	if err != nil {
+		return out, err
+	}
+
+	go c.forward(st, out)
+
+	return out, nil
+}
+
+// Send the items of the stream to out.
+func (c *Client) forward(st *Stream, out reflect.Value) {
+	defer out.Close()
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: out},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(st.ctx.Done())},
+	}
+
+	for {
+		v := reflect.New(out.Type().Elem())
+		if err := st.Recv(v.Interface()); err != nil {
+			if err != io.EOF {
+				c.abort(st.call)
+			}
+			return
+		}
+
+		cases[0].Send = v.Elem()
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			return
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// Batch accumulates calls and sends them in one frame. The server replies
+// them in one frame as well. The calls are not intercepted by the
+// interceptors of Client.Use.
+type Batch struct {
+	client *Client
+	calls  []*Call
+}
+
+// Add a call to the batch. The call is complete once Do returns.
+func (b *Batch) Call(method string, params []interface{}, result interface{}) *Call {
+	call := &Call{Method: method, Params: params, Result: result, Done: make(chan *Call, 1)}
+	b.calls = append(b.calls, call)
+	return call
+}
+
+// Add a notification to the batch.
+func (b *Batch) Notify(method string, params []interface{}) {
+	call := &Call{Method: method, Params: params, Done: make(chan *Call, 1), notify: true}
+	b.calls = append(b.calls, call)
+}
+
+func (b *Batch) Do() error {
+	return b.DoContext(context.Background())
+}
+
+// Send the batch and wait until all the calls complete or ctx is done, like
+// CallRemoteContext. The error of each call is set to Call.Error.
+func (b *Batch) DoContext(ctx context.Context) error {
+	c := b.client
+
+	codec := c.codec
+	if codec == nil {
+		return ErrDisconnected
+	}
+	if len(b.calls) == 0 {
+		return nil
+	}
+
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	for _, call := range b.calls {
+		if call.Result != nil && reflect.TypeOf(call.Result).Kind() != reflect.Ptr {
+			return fmt.Errorf("result must be a pointer")
+		}
+	}
+
+	timeout, err := timeoutOf(ctx)
+	if err != nil {
+		return err
+	}
+
+	header := c.headerOf(ctx)
+	req := &Request{kind: kindBatch}
+	var pending []*Call
+	for _, call := range b.calls {
+		call.Header = header
+		if !call.notify {
+			if err := c.register(call); err != nil {
+				b.fail(pending, err)
+				return err
+			}
+			pending = append(pending, call)
+		}
+		req.batch = append(req.batch, &Request{Id: call.id, Method: call.Method, Header: header, Timeout: timeout, params: call.Params})
+	}
+
+	err = codec.WriteRequest(req)
+	if err != nil {
+		b.fail(pending, err)
+		return err
+	}
+
+	for _, call := range pending {
+		select {
+		case <-call.Done:
+			call.done() // keep it in Done for the caller
+		case <-ctx.Done():
+			err = ctx.Err()
+			if err == context.DeadlineExceeded {
+				err = ErrTimeout
+			}
+			for _, call := range pending {
+				if c.abort(call) {
+					call.Error = err
+					call.done()
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *Batch) fail(calls []*Call, err error) {
+	for _, call := range calls {
+		if b.client.unregister(call) {
+			call.Error = err
+			call.done()
+		}
+	}
+}
+
+// caller makes the remote calls of the funcs made by makeFunc.
+type caller interface {
+	invoke(ctx context.Context, opts funcOptions, params []interface{}, result interface{}) error
+	Notify(method string, params []interface{}) error
+	callStream(ctx context.Context, method string, params []interface{}, elemType reflect.Type) (reflect.Value, error)
+}
+
+// Make all func fields of *client by makeFunc.
+func makeClient(client interface{}, makeFunc func(fptr interface{}, opts funcOptions) error) error {
 	t := reflect.TypeOf(client)
 	v := reflect.ValueOf(client)
 	if v.Kind() != reflect.Ptr {
@@ -45,7 +705,14 @@ func (c *Client) MakeClient(client interface{}) error {
 		if !vf.CanAddr() || !vf.Addr().CanInterface() {
 			continue
 		}
-		err := c.MakeFunc(tf.Name, vf.Addr().Interface())
+		opts, err := parseTag(tf.Tag.Get("rpc"))
+		if err != nil {
+			return fmt.Errorf("field %s: %v", tf.Name, err.Error())
+		}
+		if opts.name == "" {
+			opts.name = tf.Name
+		}
+		err = makeFunc(vf.Addr().Interface(), opts)
 		if err != nil {
 			return err
 		}
@@ -59,7 +726,8 @@ func (c *Client) MakeClient(client interface{}) error {
 	return nil
 }
 
-func (c *Client) MakeFunc(method string, fptr interface{}) (err error) {
+// Make *fptr a func that calls the remote method by cl, and return it.
+func makeFunc(cl caller, fptr interface{}, opts funcOptions) (v reflect.Value, err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			if er, ok := e.(error); ok {
@@ -75,6 +743,7 @@ func (c *Client) MakeFunc(method string, fptr interface{}) (err error) {
 	}()
 
 	fn := reflect.ValueOf(fptr).Elem()
+	method := opts.name
 
 	// f must return error as last param
 	nOut := fn.Type().NumOut()
@@ -89,110 +758,76 @@ func (c *Client) MakeFunc(method string, fptr interface{}) (err error) {
 		return
 	}
 
+	if opts.notify && nOut != 1 {
+		err = fmt.Errorf("%s notification must return error only", method)
+		return
+	}
+
+	if nOut == 2 && fn.Type().Out(0).Kind() == reflect.Chan && (opts.timeout > 0 || opts.idempotent) {
+		err = fmt.Errorf("%s stream can't have timeout or retry", method)
+		return
+	}
+
 	// make func
 	f := func(in []reflect.Value) []reflect.Value {
-		out := c.call(fn, method, in)
+		if opts.notify {
+			return notifyFunc(cl, fn, method, in)
+		}
+		out := callFunc(cl, fn, opts, in)
 		return out
 	}
 
-	v := reflect.MakeFunc(fn.Type(), f)
+	v = reflect.MakeFunc(fn.Type(), f)
 	fn.Set(v)
-
-	// register type
-	err = codecRegisterFuncTypes(c.codec, v.Interface())
-	if err != nil {
-		return err
-	}
-
-	return
-}
-
-func (c *Client) SetTimeout(timeout time.Duration) {
-	c.timeout = timeout
+	return v, nil
 }
 
-func (c *Client) CallRemote(method string, params []interface{}, result interface{}) error {
-	codec := c.codec
-	if codec == nil {
-		return ErrDisconnected
-	}
+func callFunc(cl caller, fn reflect.Value, opts funcOptions, inArgs []reflect.Value) []reflect.Value {
+	ctx, params := buildParams(fn, inArgs)
+	method := opts.name
 
-	rv := reflect.TypeOf(result)
-	if rv.Kind() != reflect.Ptr {
-		return fmt.Errorf("result must be a pointer")
+	if fn.Type().NumOut() == 2 && fn.Type().Out(0).Kind() == reflect.Chan {
+		ch, err := cl.callStream(ctx, method, params, fn.Type().Out(0).Elem())
+		if err != nil {
+			return returnCallError(fn, err)
+		}
+		return []reflect.Value{ch, reflect.Zero(fn.Type().Out(1))}
 	}
 
-	id := atomic.AddInt64(&c.reqid, 1)
-	ch := make(chan *Response)
-
-	c.lock.Lock()
-	c.reqMap[id] = ch
-	c.lock.Unlock()
-
-	err := codec.WriteRequest(id, method, params)
-
-	if err != nil {
-		c.lock.Lock()
-		delete(c.reqMap, id)
-		c.lock.Unlock()
-		return err
-	}
+	result := buildOutValue(fn)
 
-	var resp *Response
+	err := cl.invoke(ctx, opts, params, result)
 
-	if c.timeout > 0 {
-		select {
-		case resp = <-ch:
-		case <-time.After(c.timeout):
-			c.lock.Lock()
-			delete(c.reqMap, id)
-			c.lock.Unlock()
-			return ErrTimeout
-		}
-	} else {
-		resp = <-ch
-	}
+	return returnCall(fn, result, err)
+}
 
-	if resp.Error != nil {
-		return resp.Error
-	}
+func notifyFunc(cl caller, fn reflect.Value, method string, inArgs []reflect.Value) []reflect.Value {
+	_, params := buildParams(fn, inArgs)
 
-	if result != nil {
-		err = resp.Result(result)
-	}
+	err := cl.Notify(method, params)
 
-	return err
+	return returnCall(fn, nil, err)
 }
 
-func (c *Client) onResponse(resp *Response) error {
-	c.lock.Lock()
-	ch, ok := c.reqMap[resp.Id]
-	delete(c.reqMap, resp.Id)
-	c.lock.Unlock()
+func buildParams(fn reflect.Value, inArgs []reflect.Value) (ctx context.Context, params []interface{}) {
+	ctx = context.Background()
 
-	if !ok { // TODO error
-		return nil
+	// the first arg is not sent if it's a context
+	if fn.Type().NumIn() > 0 && fn.Type().In(0) == typeOfContext {
+		if x, ok := inArgs[0].Interface().(context.Context); ok && x != nil {
+			ctx = x
+		}
+		inArgs = inArgs[1:]
 	}
 
-	ch <- resp
-
-	return nil
-}
-
-func (c *Client) call(fn reflect.Value, method string, inArgs []reflect.Value) []reflect.Value {
-	params := make([]interface{}, len(inArgs))
+	params = make([]interface{}, len(inArgs))
 	for i := 0; i < len(inArgs); i++ {
 		params[i] = inArgs[i].Interface()
 	}
-
-	result := c.buildOutValue(fn)
-
-	err := c.CallRemote(method, params, &result)
-
-	return c.returnCall(fn, result, err)
+	return ctx, params
 }
 
-func (c *Client) buildOutValue(fn reflect.Value) interface{} {
+func buildOutValue(fn reflect.Value) interface{} {
 	var outNum = fn.Type().NumOut()
 
 	if outNum < 2 {
@@ -205,37 +840,35 @@ func (c *Client) buildOutValue(fn reflect.Value) interface{} {
 
 	outType := fn.Type().Out(0)
 
-	v := reflect.New(outType).Elem()
-
-	return v.Interface()
+	return reflect.New(outType).Interface() // a pointer to decode result into
 }
 
-func (c *Client) returnCall(fn reflect.Value, out interface{}, err error) []reflect.Value {
+func returnCall(fn reflect.Value, out interface{}, err error) []reflect.Value {
 	var outNum = fn.Type().NumOut()
 	var outs = make([]reflect.Value, 0, outNum)
 
 	if err != nil { // return err
-		return c.returnCallError(fn, err)
+		return returnCallError(fn, err)
 	}
 
 	if outNum == 1 {
 		if out != nil {
-			return c.returnCallError(fn, fmt.Errorf("out result is not handled: %v", out))
+			return returnCallError(fn, fmt.Errorf("out result is not handled: %v", out))
 		}
 		outs = append(outs, reflect.Zero(fn.Type().Out(outNum-1))) // zero value for last error
 		return outs
 	}
 
 	if outNum != 2 {
-		return c.returnCallError(fn, fmt.Errorf("invalid out len, %v != %v, %#v", len(outs), outNum, out))
+		return returnCallError(fn, fmt.Errorf("invalid out len, %v != %v, %#v", len(outs), outNum, out))
 	}
-	outs = append(outs, reflect.ValueOf(out))
+	outs = append(outs, reflect.ValueOf(out).Elem())
 	outs = append(outs, reflect.Zero(fn.Type().Out(outNum-1)))
 
 	return outs
 }
 
-func (c *Client) returnCallError(fn reflect.Value, err error) []reflect.Value {
+func returnCallError(fn reflect.Value, err error) []reflect.Value {
 	var outNum = fn.Type().NumOut()
 	var outs = make([]reflect.Value, outNum)
 
@@ -245,3 +878,107 @@ func (c *Client) returnCallError(fn reflect.Value, err error) []reflect.Value {
 	outs[outNum-1] = reflect.ValueOf(&err).Elem()
 	return outs
 }
+
+// The time left until the deadline of ctx, or 0 if it has no deadline. It
+// fails with ErrTimeout if the deadline has passed.
+func timeoutOf(ctx context.Context) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, ErrTimeout
+	}
+	return timeout, nil
+}
+
+// Wrap invoker by the interceptors, the first one is the outermost.
+func intercept(invoker Invoker, ics []ClientInterceptor) Invoker {
+	for i := len(ics) - 1; i >= 0; i-- {
+		ic, next := ics[i], invoker
+		invoker = func(ctx context.Context, method string, params []interface{}, result interface{}) error {
+			return ic(ctx, method, params, result, next)
+		}
+	}
+	return invoker
+}
+
+// Options of a func made by MakeClient.
+type funcOptions struct {
+	name       string // of the remote method
+	timeout    time.Duration
+	retry      int  // times to call again, if hasRetry
+	hasRetry   bool // retry is set, even if it's 0
+	idempotent bool
+	notify     bool
+}
+
+// How many times to try a call by policy, once if it's not idempotent.
+func (opts *funcOptions) attempts(policy *RetryPolicy, idempotent *methodSet) int {
+	if opts.hasRetry {
+		return opts.retry + 1
+	}
+	if opts.idempotent || idempotent.has(opts.name) {
+		return policy.MaxAttempts
+	}
+	return 1
+}
+
+// Parse options of a struct tag like `rpc:"name=Svc.Echo,timeout=2s,retry=3"`.
+func parseTag(tag string) (opts funcOptions, err error) {
+	seen := make(map[string]bool)
+	for _, opt := range strings.Split(tag, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+
+		key, value := opt, ""
+		hasValue := false
+		if i := strings.Index(opt, "="); i >= 0 {
+			key, value, hasValue = strings.TrimSpace(opt[:i]), strings.TrimSpace(opt[i+1:]), true
+		}
+		if seen[key] {
+			return opts, fmt.Errorf("duplicate option %q", key)
+		}
+		seen[key] = true
+
+		switch key {
+		case "notify":
+			if hasValue {
+				return opts, fmt.Errorf("option notify takes no value")
+			}
+			opts.notify = true
+		case "idempotent":
+			if hasValue {
+				return opts, fmt.Errorf("option idempotent takes no value")
+			}
+			opts.idempotent = true
+		case "name":
+			if value == "" {
+				return opts, fmt.Errorf("option name is empty")
+			}
+			opts.name = value
+		case "timeout":
+			opts.timeout, err = time.ParseDuration(value)
+			if err != nil || opts.timeout <= 0 {
+				return opts, fmt.Errorf("invalid timeout %q", value)
+			}
+		case "retry":
+			opts.retry, err = strconv.Atoi(value)
+			if err != nil || opts.retry < 0 {
+				return opts, fmt.Errorf("invalid retry %q", value)
+			}
+			opts.hasRetry = true
+			opts.idempotent = true
+		default:
+			return opts, fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	if opts.notify && (opts.timeout > 0 || opts.idempotent) {
+		return opts, fmt.Errorf("notify can't have timeout or retry")
+	}
+	return opts, nil
+}
@@ -3,11 +3,20 @@ package rpc
 import (
 	"fmt"
 	"reflect"
+	"time"
 )
 
+// Codec reads and writes requests and responses on a connection.
+//
+// WriteRequest and WriteResponse may be called concurrently from many
+// goroutines, so an implementation must serialize them and never interleave
+// two frames on the connection. Read is only called by one goroutine.
+//
+// Besides plain calls, a frame may be of another kind, e.g. a cancel request.
+// The kind must be written and read back as is.
 type Codec interface {
-	WriteRequest(id int64, method string, params []interface{}) (err error)
-	WriteResponse(id int64, result interface{}, e *Error) (err error)
+	WriteRequest(req *Request) (err error)
+	WriteResponse(resp *Response) (err error)
 
 	Read() (req *Request, resp *Response, err error)
 
@@ -19,20 +28,53 @@ type Codec interface {
 
 ///////////////////////////////////////////////////////////
 
+// Kinds of frames other than plain calls.
+const (
+	kindCancel  = "cancel"  // request to cancel the call of Id
+	kindBatch   = "batch"   // requests or responses in one frame
+	kindOpen    = "open"    // response that the stream of Id is opened
+	kindItem    = "item"    // response of an item in the stream of Id
+	kindAck     = "ack"     // request that the caller has taken n more items
+	kindSend    = "send"    // request of an item sent by the caller
+	kindEnd     = "end"     // request that the caller has done sending
+	kindAckSend = "acksend" // response that the handler has taken n more items
+	kindInvalid = "invalid" // request that can't be decoded, only read
+)
+
+// Max number of items sent in a stream before the caller takes them.
+const streamWindow = 32
+
+// Whether a frame of the kind is read as a Request or a Response
+func isRequestKind(kind string) bool {
+	switch kind {
+	case kindCancel, kindAck, kindSend, kindEnd:
+		return true
+	}
+	return false
+}
+
+// A Request of Id 0 is a notification, which expects no Response.
 type Request struct {
-	Id     int64
-	Method string
+	Id      int64
+	Method  string
+	Header  Header
+	Timeout time.Duration // how long the caller waits, or 0 if unlimited
 
+	kind   string
 	codec  Codec
 	params []interface{}
+	batch  []*Request
 }
 
 type Response struct {
-	Id    int64
-	Error *Error
+	Id     int64
+	Error  *Error
+	Header Header // trailers set by the handler
 
+	kind   string
 	codec  Codec
 	result interface{}
+	batch  []*Response
 }
 
 func (req *Request) Len() int {
@@ -54,8 +96,8 @@ func (resp *Response) Result(pv interface{}) error {
 ////////////////////////////////////////////////////////////////////////////////
 
 type Error struct {
-	Code    int    `"json:"code"`
-	Message string `"json:"message"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 func NewError(code int, msg string) *Error {
@@ -113,13 +155,19 @@ func codecRegisterFuncTypes(c Codec, f interface{}) (err error) {
 }
 
 func codecMakeValue(t reflect.Type) *reflect.Value {
+	if t == typeOfStream { // never on the wire
+		return nil
+	}
+
 	var v reflect.Value
 	if v.Kind() == reflect.Ptr || v.Kind() == reflect.UnsafePointer {
 		t = t.Elem()
 	}
 
 	switch t.Kind() {
-	case reflect.Chan, reflect.Func, reflect.Interface:
+	case reflect.Chan: // items of a stream
+		return codecMakeValue(t.Elem())
+	case reflect.Func, reflect.Interface:
 		return nil
 	case reflect.Map:
 		v = reflect.MakeMap(t)
@@ -3,8 +3,11 @@ package rpc
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 type fooType struct {
@@ -40,6 +43,80 @@ func TestJsonCodec(t *testing.T) {
 	testCodec(c, s, t)
 }
 
+func TestCodecConcurrentWrite(t *testing.T) {
+	for _, newCodec := range []func(io.ReadWriteCloser) Codec{NewGobCodec, NewJsonCodec} {
+		var buf = new(buffer)
+		c := newCodec(buf)
+		s := newCodec(buf)
+
+		var n = 50
+		var wg sync.WaitGroup
+		for i := 1; i <= n; i++ {
+			wg.Add(1)
+			go func(id int64) {
+				defer wg.Done()
+				var err error
+				if id%2 == 0 {
+					err = c.WriteRequest(&Request{Id: id, Method: "foo", params: []interface{}{"tom", id}})
+				} else {
+					err = c.WriteResponse(&Response{Id: id, result: "bar"})
+				}
+				if err != nil {
+					t.Error(err.Error())
+				}
+			}(int64(i))
+		}
+		wg.Wait()
+
+		for i := 0; i < n; i++ {
+			req, resp, err := s.Read()
+			if err != nil {
+				t.Fatal(err.Error(), i)
+			}
+			if req != nil && req.Id%2 != 0 {
+				t.Fatal("request id not match", req.Id)
+			}
+			if resp != nil && resp.Id%2 == 0 {
+				t.Fatal("response id not match", resp.Id)
+			}
+		}
+	}
+}
+
+func TestJsonCodecNotify(t *testing.T) {
+	var buf = new(buffer)
+	c := NewJsonCodec(buf)
+
+	err := c.WriteRequest(&Request{Id: 0, Method: "foo", params: []interface{}{"tom"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"id"`)) {
+		t.Fatal("notification should have no id", buf.String())
+	}
+
+	req, _, err := c.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if req == nil || req.Id != 0 || req.Method != "foo" {
+		t.Fatal("notification not match", req)
+	}
+}
+
+func TestJsonCodecBatch(t *testing.T) {
+	var buf = new(buffer)
+	c := NewJsonCodec(buf)
+
+	err := c.WriteRequest(&Request{kind: kindBatch, batch: []*Request{{Id: 1, Method: "foo"}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("[")) {
+		t.Fatal("batch should be an array", buf.String())
+	}
+}
+
 func testCodec(c, s Codec, t *testing.T) {
 	var id int64 = 123
 	var method string = "foo"
@@ -51,6 +128,12 @@ func testCodec(c, s Codec, t *testing.T) {
 
 	writeAndCheckResponse(c, s, id, nil, nil, t)
 
+	writeAndCheckCancel(c, s, id, t)
+
+	writeAndCheckHeader(c, s, id, t)
+
+	writeAndCheckBatch(c, s, t)
+
 	//writeAndCheckResponse(c, s, id, 30, nil, t)
 
 	//writeAndCheckResponse(c, s, id, nil, ErrInvalidParams, t)
@@ -58,7 +141,7 @@ func testCodec(c, s Codec, t *testing.T) {
 
 func writeAndCheckRequest(c, s Codec, id int64, method string, params []interface{}, t *testing.T) {
 	// client write request
-	err := c.WriteRequest(id, method, params)
+	err := c.WriteRequest(&Request{Id: id, Method: method, params: params})
 	if err != nil {
 		t.Fatal(err.Error(), method, params)
 	}
@@ -100,9 +183,88 @@ func writeAndCheckRequest(c, s Codec, id int64, method string, params []interfac
 	}
 }
 
+func writeAndCheckCancel(c, s Codec, id int64, t *testing.T) {
+	err := c.WriteRequest(&Request{Id: id, kind: kindCancel})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, resp, err := s.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp != nil {
+		t.Fatal("should not be resp:", resp)
+	}
+	if req.Id != id || req.kind != kindCancel {
+		t.Fatal("cancel not match", req)
+	}
+}
+
+func writeAndCheckBatch(c, s Codec, t *testing.T) {
+	err := c.WriteRequest(&Request{kind: kindBatch, batch: []*Request{
+		{Id: 1, Method: "foo", params: []interface{}{"tom"}},
+		{Id: 0, Method: "bar"},
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, resp, err := s.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp != nil || req.kind != kindBatch || len(req.batch) != 2 {
+		t.Fatal("batch request not match", req, resp)
+	}
+	if req.batch[0].Id != 1 || req.batch[0].Method != "foo" || req.batch[1].Method != "bar" {
+		t.Fatal("batch request not match", req.batch[0], req.batch[1])
+	}
+	var name string
+	if err = req.batch[0].Param(0, &name); err != nil || name != "tom" {
+		t.Fatal("param not match", name, err)
+	}
+
+	err = s.WriteResponse(&Response{kind: kindBatch, batch: []*Response{
+		{Id: 1, result: "ok"},
+		{Id: 2, Error: ErrMethodNotFound},
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, resp, err = c.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if req != nil || resp.kind != kindBatch || len(resp.batch) != 2 {
+		t.Fatal("batch response not match", req, resp)
+	}
+	var ret string
+	if err = resp.batch[0].Result(&ret); err != nil || ret != "ok" {
+		t.Fatal("result not match", ret, err)
+	}
+	if resp.batch[1].Id != 2 || resp.batch[1].Error.Code != CodeMethodNotFound {
+		t.Fatal("error not match", resp.batch[1])
+	}
+
+	// empty
+	err = c.WriteRequest(&Request{kind: kindBatch})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req, resp, err = s.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp != nil || req.kind != kindBatch || len(req.batch) != 0 {
+		t.Fatal("empty batch not match", req, resp)
+	}
+}
+
 func writeAndCheckResponse(c, s Codec, id int64, result interface{}, e *Error, t *testing.T) {
 	// server write response
-	err := s.WriteResponse(id, result, e)
+	err := s.WriteResponse(&Response{Id: id, Error: e, result: result})
 	if err != nil {
 		t.Fatal(err.Error())
 	}
@@ -172,3 +334,36 @@ type buffer struct {
 func (b *buffer) Close() error {
 	return nil
 }
+
+func writeAndCheckHeader(c, s Codec, id int64, t *testing.T) {
+	header := Header{"token": "abc", "trace": "123"}
+	err := c.WriteRequest(&Request{Id: id, Method: "foo", Header: header, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	req, _, err := s.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if req == nil || !reflect.DeepEqual(req.Header, header) {
+		t.Fatal("header not match", req, header)
+	}
+	if req.Timeout != time.Second {
+		t.Fatal("timeout not match", req.Timeout)
+	}
+
+	trailer := Header{"cost": "10"}
+	err = s.WriteResponse(&Response{Id: id, Header: trailer})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, resp, err := c.Read()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if resp == nil || !reflect.DeepEqual(resp.Header, trailer) {
+		t.Fatal("trailer not match", resp, trailer)
+	}
+}
@@ -3,6 +3,8 @@ package rpc
 import (
 	"encoding/gob"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/tiaotiao/go/util"
 )
@@ -11,6 +13,8 @@ type GobCodec struct {
 	conn io.ReadWriteCloser
 	enc  *gob.Encoder
 	dec  *gob.Decoder
+
+	wlock sync.Mutex // serialize writes
 }
 
 func NewGobCodec(conn io.ReadWriteCloser) Codec {
@@ -21,18 +25,40 @@ func NewGobCodec(conn io.ReadWriteCloser) Codec {
 	return c
 }
 
-func (c *GobCodec) WriteRequest(id int64, method string, params []interface{}) (err error) {
-	d := gobdata{Id: id, Method: method, Params: params}
-	err = c.enc.Encode(&d) // encode and write
+func (c *GobCodec) WriteRequest(req *Request) (err error) {
+	d := c.requestData(req)
+	err = c.write(d)
 	return err
 }
 
-func (c *GobCodec) WriteResponse(id int64, result interface{}, e *Error) (err error) {
-	d := gobdata{Id: id, Result: result, Error: e}
-	err = c.enc.Encode(&d) // encode and write
+func (c *GobCodec) WriteResponse(resp *Response) (err error) {
+	d := c.responseData(resp)
+	err = c.write(d)
 	return err
 }
 
+func (c *GobCodec) requestData(req *Request) *gobdata {
+	d := &gobdata{Id: req.Id, Method: req.Method, Kind: req.kind, Params: req.params, Header: req.Header, Timeout: req.Timeout}
+	for _, r := range req.batch {
+		d.Batch = append(d.Batch, c.requestData(r))
+	}
+	return d
+}
+
+func (c *GobCodec) responseData(resp *Response) *gobdata {
+	d := &gobdata{Id: resp.Id, Kind: resp.kind, Result: resp.result, Error: resp.Error, Header: resp.Header}
+	for _, r := range resp.batch {
+		d.Batch = append(d.Batch, c.responseData(r))
+	}
+	return d
+}
+
+func (c *GobCodec) write(d *gobdata) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.enc.Encode(d) // encode and write
+}
+
 func (c *GobCodec) Read() (req *Request, resp *Response, err error) {
 	var r gobdata
 	err = c.dec.Decode(&r) // read and decode
@@ -40,14 +66,43 @@ func (c *GobCodec) Read() (req *Request, resp *Response, err error) {
 		return
 	}
 
-	if r.Method != "" {
-		req = &Request{Id: r.Id, Method: r.Method, params: r.Params, codec: c}
+	// a batch
+	if r.Kind == kindBatch {
+		if len(r.Batch) == 0 { // replied ErrInvalidRequest by the server
+			req = &Request{kind: kindBatch, codec: c}
+			return
+		}
+
+		if r.Batch[0].Method != "" {
+			req = &Request{kind: kindBatch, codec: c}
+			for _, b := range r.Batch {
+				req.batch = append(req.batch, c.newRequest(b))
+			}
+		} else {
+			resp = &Response{kind: kindBatch, codec: c}
+			for _, b := range r.Batch {
+				resp.batch = append(resp.batch, c.newResponse(b))
+			}
+		}
+		return
+	}
+
+	if r.Method != "" || isRequestKind(r.Kind) {
+		req = c.newRequest(&r)
 	} else {
-		resp = &Response{Id: r.Id, result: r.Result, Error: r.Error, codec: c}
+		resp = c.newResponse(&r)
 	}
 	return
 }
 
+func (c *GobCodec) newRequest(r *gobdata) *Request {
+	return &Request{Id: r.Id, Method: r.Method, Header: r.Header, Timeout: r.Timeout, kind: r.Kind, params: r.Params, codec: c}
+}
+
+func (c *GobCodec) newResponse(r *gobdata) *Response {
+	return &Response{Id: r.Id, Header: r.Header, kind: r.Kind, result: r.Result, Error: r.Error, codec: c}
+}
+
 func (c *GobCodec) Unmarshal(data interface{}, pv interface{}) error {
 	return util.Assign(pv, data)
 }
@@ -65,9 +120,13 @@ func (c *GobCodec) Close() error {
 
 // Combine Request and Response for decode
 type gobdata struct {
-	Id     int64
-	Method string
-	Params []interface{}
-	Result interface{}
-	Error  *Error
+	Id      int64
+	Method  string
+	Kind    string
+	Params  []interface{}
+	Result  interface{}
+	Error   *Error
+	Batch   []*gobdata
+	Header  Header
+	Timeout time.Duration
 }
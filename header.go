@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+)
+
+// Header is the metadata of a call, like auth tokens or trace ids, sent with
+// the request. The Header of a Response holds the trailers set by the handler.
+type Header map[string]string
+
+type headerKey struct{}  // Header to send, on the caller side
+type trailerKey struct{} // Header to receive the trailers into, on the caller side
+type requestKey struct{} // *Request being handled, on the handler side
+type replyKey struct{}   // *trailer to reply, on the handler side
+
+// Add a header to the calls made with the returned context.
+func WithHeader(ctx context.Context, key, value string) context.Context {
+	h := Header{key: value}
+	for k, v := range headerFromContext(ctx) {
+		if k != key {
+			h[k] = v
+		}
+	}
+	return context.WithValue(ctx, headerKey{}, h)
+}
+
+// Receive the trailers of the call made with the returned context into
+// trailer, which must not be nil.
+func WithTrailer(ctx context.Context, trailer Header) context.Context {
+	return context.WithValue(ctx, trailerKey{}, trailer)
+}
+
+// The headers of the request handled with ctx, or nil.
+func HeaderFromContext(ctx context.Context) Header {
+	if req, ok := ctx.Value(requestKey{}).(*Request); ok {
+		return req.Header
+	}
+	return nil
+}
+
+// Set a trailer of the response to the request handled with ctx. It's
+// ignored if ctx is not of a request, or the request is a notification.
+func SetTrailer(ctx context.Context, key, value string) {
+	if t, ok := ctx.Value(replyKey{}).(*trailer); ok {
+		t.set(key, value)
+	}
+}
+
+func headerFromContext(ctx context.Context) Header {
+	h, _ := ctx.Value(headerKey{}).(Header)
+	return h
+}
+
+// Merge the headers of ctx into the default ones, or nil if there's none.
+func mergeHeader(defaults Header, ctx context.Context) Header {
+	h := headerFromContext(ctx)
+	if len(defaults) == 0 {
+		return h
+	}
+	if len(h) == 0 {
+		return defaults
+	}
+
+	merged := make(Header, len(defaults)+len(h))
+	for k, v := range defaults {
+		merged[k] = v
+	}
+	for k, v := range h {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Copy the trailers of the call into the Header of ctx, if any.
+func receiveTrailer(ctx context.Context, call *Call) {
+	if t, ok := ctx.Value(trailerKey{}).(Header); ok && t != nil {
+		for k, v := range call.Trailer {
+			t[k] = v
+		}
+	}
+}
+
+// The trailers set by the handler, which may be set concurrently.
+type trailer struct {
+	lock sync.Mutex
+	h    Header
+}
+
+func (t *trailer) set(key, value string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.h == nil {
+		t.h = make(Header)
+	}
+	t.h[key] = value
+}
+
+func (t *trailer) header() Header {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.h
+}
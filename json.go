@@ -1,8 +1,11 @@
 package rpc
 
 import (
+	"bytes"
 	"encoding/json"
 	"io"
+	"sync"
+	"time"
 )
 
 //////////////////////////////////////////////////////////////////
@@ -11,6 +14,8 @@ type JsonCodec struct {
 	conn io.ReadWriteCloser
 	enc  *json.Encoder
 	dec  *json.Decoder
+
+	wlock sync.Mutex // serialize writes
 }
 
 func NewJsonCodec(conn io.ReadWriteCloser) Codec {
@@ -21,50 +26,153 @@ func NewJsonCodec(conn io.ReadWriteCloser) Codec {
 	return c
 }
 
-func (c *JsonCodec) WriteRequest(id int64, method string, params []interface{}) (err error) {
-	d := jsondata{Id: id, Method: method}
+// A batch is written as an array of requests, as in JSON-RPC 2.0.
+func (c *JsonCodec) WriteRequest(req *Request) (err error) {
+	if req.kind == kindBatch {
+		ds := make([]*jsondata, len(req.batch))
+		for i, r := range req.batch {
+			ds[i], err = c.requestData(r)
+			if err != nil {
+				return err
+			}
+		}
+		return c.write(ds)
+	}
+
+	d, err := c.requestData(req)
+	if err != nil {
+		return err
+	}
+	err = c.write(d)
+	return err
+}
+
+// A batch is written as an array of responses, as in JSON-RPC 2.0.
+func (c *JsonCodec) WriteResponse(resp *Response) (err error) {
+	if resp.kind == kindBatch {
+		ds := make([]*jsondata, len(resp.batch))
+		for i, r := range resp.batch {
+			ds[i], err = c.responseData(r)
+			if err != nil {
+				return err
+			}
+		}
+		return c.write(ds)
+	}
+
+	d, err := c.responseData(resp)
+	if err != nil {
+		return err
+	}
+	err = c.write(d)
+	return err
+}
+
+func (c *JsonCodec) requestData(req *Request) (d *jsondata, err error) {
+	d = &jsondata{Id: req.Id, Method: req.Method, Kind: req.kind, Header: req.Header}
+	if req.Timeout > 0 { // in milliseconds, rounded up
+		d.Timeout = int64((req.Timeout + time.Millisecond - 1) / time.Millisecond)
+	}
 
 	var raw json.RawMessage
-	for _, param := range params {
+	for _, param := range req.params {
 		raw, err = json.Marshal(param)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		d.Params = append(d.Params, raw)
 	}
-
-	err = c.enc.Encode(&d) // encode and write
-	return err
+	return d, nil
 }
 
-func (c *JsonCodec) WriteResponse(id int64, result interface{}, e *Error) (err error) {
-	d := jsondata{Id: id, Error: e}
-	d.Result, err = json.Marshal(result)
+func (c *JsonCodec) responseData(resp *Response) (d *jsondata, err error) {
+	d = &jsondata{Id: resp.Id, Kind: resp.kind, Error: resp.Error, Header: resp.Header}
+	d.Result, err = json.Marshal(resp.result)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = c.enc.Encode(&d) // encode and write
-	return err
+	return d, nil
+}
+
+func (c *JsonCodec) write(v interface{}) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.enc.Encode(v) // encode and write
 }
 
 func (c *JsonCodec) Read() (req *Request, resp *Response, err error) {
-	var r jsondata
-	err = c.dec.Decode(&r) // read and decode
+	var raw json.RawMessage
+	err = c.dec.Decode(&raw) // read
 	if err != nil {
 		return
 	}
 
-	if r.Method != "" {
-		req = &Request{Id: r.Id, Method: r.Method, codec: c}
-		for _, p := range r.Params {
-			req.params = append(req.params, p)
+	// a batch
+	if b := bytes.TrimLeft(raw, " \t\r\n"); len(b) > 0 && b[0] == '[' {
+		var raws []json.RawMessage
+		err = json.Unmarshal(raw, &raws)
+		if err != nil {
+			return
 		}
+
+		// decode one by one, the invalid ones are nil
+		rs := make([]*jsondata, len(raws))
+		isRequest := true // by the first valid one, or if there is none
+		for i := len(raws) - 1; i >= 0; i-- {
+			var r jsondata
+			if json.Unmarshal(raws[i], &r) == nil {
+				rs[i] = &r
+				isRequest = r.Method != ""
+			}
+		}
+
+		if isRequest {
+			req = &Request{kind: kindBatch, codec: c}
+			for _, r := range rs {
+				if r == nil { // replied ErrInvalidRequest by the server
+					req.batch = append(req.batch, &Request{kind: kindInvalid, codec: c})
+				} else {
+					req.batch = append(req.batch, c.newRequest(r))
+				}
+			}
+		} else {
+			resp = &Response{kind: kindBatch, codec: c}
+			for _, r := range rs {
+				if r != nil {
+					resp.batch = append(resp.batch, c.newResponse(r))
+				}
+			}
+		}
+		return
+	}
+
+	var r jsondata
+	if json.Unmarshal(raw, &r) != nil { // replied ErrInvalidRequest by the server
+		req = &Request{kind: kindInvalid, codec: c}
+		return
+	}
+
+	if r.Method != "" || isRequestKind(r.Kind) {
+		req = c.newRequest(&r)
 	} else {
-		resp = &Response{Id: r.Id, result: r.Result, Error: r.Error, codec: c}
+		resp = c.newResponse(&r)
 	}
 	return
 }
 
+func (c *JsonCodec) newRequest(r *jsondata) *Request {
+	req := &Request{Id: r.Id, Method: r.Method, Header: r.Header, kind: r.Kind, codec: c}
+	req.Timeout = time.Duration(r.Timeout) * time.Millisecond
+	for _, p := range r.Params {
+		req.params = append(req.params, p)
+	}
+	return req
+}
+
+func (c *JsonCodec) newResponse(r *jsondata) *Response {
+	return &Response{Id: r.Id, Header: r.Header, kind: r.Kind, result: r.Result, Error: r.Error, codec: c}
+}
+
 func (c *JsonCodec) Unmarshal(data interface{}, pv interface{}) error {
 	d := data.(json.RawMessage)
 	return json.Unmarshal(d, pv)
@@ -83,9 +191,12 @@ func (c *JsonCodec) Close() error {
 
 // Combine Request and Response for decode
 type jsondata struct {
-	Id     int64             `json:"id"`
-	Method string            `json:"method,omitempty"`
-	Params []json.RawMessage `json:"params,omitempty"`
-	Result json.RawMessage   `json:"result,omitempty"`
-	Error  *Error            `json:"error,omitempty"`
+	Id      int64             `json:"id,omitempty"` // omitted in notifications
+	Method  string            `json:"method,omitempty"`
+	Kind    string            `json:"kind,omitempty"`
+	Params  []json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage   `json:"result,omitempty"`
+	Error   *Error            `json:"error,omitempty"`
+	Header  Header            `json:"header,omitempty"`
+	Timeout int64             `json:"timeout,omitempty"` // in milliseconds
 }
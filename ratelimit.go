@@ -0,0 +1,203 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of a token bucket.
+type Limit struct {
+	Rate  float64 // tokens per second
+	Burst int     // tokens at most
+}
+
+// What to do with a request over the limit.
+type LimitMode int
+
+const (
+	LimitReject LimitMode = iota // reply ErrRateLimited
+	LimitWait                    // wait for the tokens until the deadline of the request
+)
+
+// RateLimiter limits the requests by token buckets of each connection, each
+// peer of all its connections, and each method of all connections. A request
+// takes a token from each bucket that's limited.
+//
+// It's safe to change the limits while serving. The callbacks registered by
+// the Client of a connection are not limited.
+type RateLimiter struct {
+	mode LimitMode
+
+	lock          sync.Mutex
+	conn          *Limit
+	peer          *Limit
+	methods       map[string]Limit
+	peerBuckets   map[string]*bucket
+	methodBuckets map[string]*bucket
+}
+
+func NewRateLimiter(mode LimitMode) *RateLimiter {
+	l := new(RateLimiter)
+	l.mode = mode
+	l.methods = make(map[string]Limit)
+	l.peerBuckets = make(map[string]*bucket)
+	l.methodBuckets = make(map[string]*bucket)
+	return l
+}
+
+// Limit each connection.
+func (l *RateLimiter) LimitConn(rate float64, burst int) {
+	l.lock.Lock()
+	l.conn = &Limit{rate, burst}
+	l.lock.Unlock()
+}
+
+// Limit each authenticated peer, by its name.
+func (l *RateLimiter) LimitPeer(rate float64, burst int) {
+	l.lock.Lock()
+	l.peer = &Limit{rate, burst}
+	l.lock.Unlock()
+}
+
+// Limit method of all connections.
+func (l *RateLimiter) LimitMethod(method string, rate float64, burst int) {
+	l.lock.Lock()
+	l.methods[method] = Limit{rate, burst}
+	l.lock.Unlock()
+}
+
+// A bucket to take a token from, with its limit.
+type limited struct {
+	*bucket
+	Limit
+}
+
+// Take a token of the request from each bucket, or wait for them if the mode
+// is LimitWait. It fails with ErrRateLimited, or ctx.Err() while waiting.
+func (l *RateLimiter) take(ctx context.Context, s *Server, method string) error {
+	buckets := l.buckets(ctx, s, method)
+
+	now := time.Now()
+	if l.mode == LimitReject {
+		for i, b := range buckets {
+			if !b.take(now, b.Limit) {
+				for _, b := range buckets[:i] {
+					b.refund()
+				}
+				return ErrRateLimited
+			}
+		}
+		return nil
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.reserve(now, b.Limit); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		for _, b := range buckets {
+			b.refund()
+		}
+		return ctx.Err()
+	}
+}
+
+// The buckets of the request that are limited.
+func (l *RateLimiter) buckets(ctx context.Context, s *Server, method string) []limited {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var buckets []limited
+	if l.conn != nil {
+		buckets = append(buckets, limited{s.connBucket(*l.conn), *l.conn})
+	}
+	if peer := PeerFromContext(ctx); l.peer != nil && peer != nil {
+		buckets = append(buckets, limited{bucketOf(l.peerBuckets, peer.Name, *l.peer), *l.peer})
+	}
+	if limit, ok := l.methods[method]; ok {
+		buckets = append(buckets, limited{bucketOf(l.methodBuckets, method, limit), limit})
+	}
+	return buckets
+}
+
+func bucketOf(buckets map[string]*bucket, key string, limit Limit) *bucket {
+	b, ok := buckets[key]
+	if !ok {
+		b = newBucket(limit)
+		buckets[key] = b
+	}
+	return b
+}
+
+///////////////////////////////////////////////////////////
+
+// A token bucket, which is full at first. It's refilled by the limit given
+// each time, so that the limit may change.
+type bucket struct {
+	lock   sync.Mutex
+	tokens float64 // negative if reserved ahead
+	last   time.Time
+}
+
+func newBucket(limit Limit) *bucket {
+	b := new(bucket)
+	b.tokens = float64(limit.Burst)
+	b.last = time.Now()
+	return b
+}
+
+func (b *bucket) refill(now time.Time, limit Limit) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+		b.last = now
+	}
+	if burst := float64(limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// Take a token if there's one.
+func (b *bucket) take(now time.Time, limit Limit) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now, limit)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// Take a token ahead, and return how long until it's there.
+func (b *bucket) reserve(now time.Time, limit Limit) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now, limit)
+	b.tokens -= 1
+	if b.tokens >= 0 {
+		return 0
+	}
+	if limit.Rate <= 0 {
+		return time.Duration(1<<63 - 1) // never
+	}
+	return time.Duration(-b.tokens / limit.Rate * float64(time.Second))
+}
+
+// Give back a token taken.
+func (b *bucket) refund() {
+	b.lock.Lock()
+	b.tokens += 1
+	b.lock.Unlock()
+}
@@ -0,0 +1,425 @@
+package rpc
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// State of the connection of a ReconnectClient.
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	StateDisconnected // waiting to reconnect
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// What to do with the calls pending when the connection is lost.
+type ReconnectPolicy int
+
+const (
+	FailPending  ReconnectPolicy = iota // fail them with ErrDisconnected
+	RetryPending                        // call them again once reconnected
+)
+
+// ReconnectClient calls the remote methods on a connection that's dialed
+// again whenever it's lost, waiting between attempts by exponential backoff
+// with jitter. Calls made while it's disconnected wait for the connection
+// until they time out.
+//
+// The funcs made by MakeClient and MakeFunc keep working across reconnects.
+// The setters should be called before the first call or Connect.
+type ReconnectClient struct {
+	network string
+	address string
+	dial    func(network, address string) (*Rpc, error)
+	dialer  func(ctx context.Context, network, address string) (net.Conn, error) // if dial is not set
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+	policy     ReconnectPolicy
+	onState    func(state ConnState, err error)
+	onConn     func(r *Rpc)
+
+	interceptors []ClientInterceptor
+	retry        RetryPolicy
+	idempotent   methodSet
+
+	start   sync.Once
+	lock    sync.Mutex
+	rpc     *Rpc          // nil while disconnected
+	changed chan struct{} // closed when rpc is changed
+	funcs   []interface{} // made funcs, whose types are registered to each codec
+
+	closed  chan struct{}
+	dialCtx context.Context // canceled by Close to stop dialing
+	cancel  context.CancelFunc
+	stop    sync.Once
+	exited  chan struct{}
+}
+
+func NewReconnectClient(network, address string) *ReconnectClient {
+	rc := new(ReconnectClient)
+	rc.network = network
+	rc.address = address
+	rc.dialer = (&net.Dialer{}).DialContext
+	rc.minBackoff = time.Millisecond * 100
+	rc.maxBackoff = time.Second * 10
+	rc.timeout = time.Second * 5
+	rc.retry = DefaultRetryPolicy
+	rc.changed = make(chan struct{})
+	rc.closed = make(chan struct{})
+	rc.dialCtx, rc.cancel = context.WithCancel(context.Background())
+	rc.exited = make(chan struct{})
+	return rc
+}
+
+// Set how to dial a connection. It's Dial by default, which times out as the
+// calls and is stopped by Close. Close waits for the dial set here, so it
+// should time out as well.
+func (rc *ReconnectClient) SetDial(dial func(network, address string) (*Rpc, error)) {
+	rc.dial = dial
+}
+
+// Set the backoff between attempts to dial, which starts from min and is
+// doubled on each failure up to max.
+func (rc *ReconnectClient) SetBackoff(min, max time.Duration) {
+	rc.minBackoff = min
+	rc.maxBackoff = max
+}
+
+// Set the timeout of calls, including the time waiting for the connection.
+func (rc *ReconnectClient) SetTimeout(timeout time.Duration) {
+	rc.timeout = timeout
+}
+
+// Set what to do with the pending calls when the connection is lost. They
+// fail by default, unless the methods are idempotent. Only retry them if the
+// methods are safe to call twice.
+func (rc *ReconnectClient) SetPolicy(policy ReconnectPolicy) {
+	rc.policy = policy
+}
+
+// Set the retry policy of idempotent methods, as Client.SetRetryPolicy. The
+// calls are retried on the next connection if it's lost.
+func (rc *ReconnectClient) SetRetryPolicy(policy RetryPolicy) {
+	rc.retry = policy
+}
+
+// Mark the methods idempotent, as Client.MarkIdempotent.
+func (rc *ReconnectClient) MarkIdempotent(methods ...string) {
+	rc.idempotent.add(methods...)
+}
+
+// Called on every change of the state, with the error that caused it if any.
+func (rc *ReconnectClient) OnStateChange(f func(state ConnState, err error)) {
+	rc.onState = f
+}
+
+// Called with the Rpc of each new connection before it's used, e.g. to
+// register the methods served to the remote.
+func (rc *ReconnectClient) OnConnect(f func(r *Rpc)) {
+	rc.onConn = f
+}
+
+// Add interceptors of the calls, as Client.Use. Each attempt of the retry
+// policy is intercepted, while a call retried by RetryPending is intercepted
+// once.
+func (rc *ReconnectClient) Use(interceptors ...ClientInterceptor) {
+	rc.interceptors = append(rc.interceptors, interceptors...)
+}
+
+// Wait until it's connected or ctx is done.
+func (rc *ReconnectClient) Connect(ctx context.Context) error {
+	_, err := rc.wait(ctx)
+	return err
+}
+
+// The Rpc of the current connection, or nil if it's disconnected.
+func (rc *ReconnectClient) Rpc() *Rpc {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.rpc
+}
+
+// Close the connection and stop reconnecting. Calls fail with ErrClientClosed.
+func (rc *ReconnectClient) Close() error {
+	rc.stop.Do(func() {
+		close(rc.closed)
+		rc.cancel()
+	})
+	rc.start.Do(func() { // never started
+		close(rc.exited)
+	})
+	<-rc.exited
+	return nil
+}
+
+// Make all func fields of *client call the remote methods of the same names,
+// as Client.MakeClient.
+func (rc *ReconnectClient) MakeClient(client interface{}) error {
+	return makeClient(client, rc.makeFunc)
+}
+
+// Make *fptr a func that calls the remote method, as Client.MakeFunc.
+func (rc *ReconnectClient) MakeFunc(method string, fptr interface{}) error {
+	return rc.makeFunc(fptr, funcOptions{name: method})
+}
+
+// Make *fptr a func that sends notifications, as Client.MakeNotify.
+func (rc *ReconnectClient) MakeNotify(method string, fptr interface{}) error {
+	return rc.makeFunc(fptr, funcOptions{name: method, notify: true})
+}
+
+func (rc *ReconnectClient) makeFunc(fptr interface{}, opts funcOptions) error {
+	v, err := makeFunc(rc, fptr, opts)
+	if err != nil {
+		return err
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.funcs = append(rc.funcs, v.Interface())
+	if rc.rpc != nil {
+		return codecRegisterFuncTypes(rc.rpc.codec, v.Interface())
+	}
+	return nil
+}
+
+func (rc *ReconnectClient) CallRemote(method string, params []interface{}, result interface{}) error {
+	return rc.CallRemoteContext(context.Background(), method, params, result)
+}
+
+// Call a remote method as Client.CallRemoteContext. It waits for the
+// connection if it's disconnected, and calls again on the next connection if
+// it's lost before the call completes and the policy is RetryPending.
+func (rc *ReconnectClient) CallRemoteContext(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	return rc.invoke(ctx, funcOptions{name: method}, params, result)
+}
+
+func (rc *ReconnectClient) invoke(ctx context.Context, opts funcOptions, params []interface{}, result interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && rc.timeout > 0 && opts.timeout <= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	invoker := intercept(rc.callRemote, rc.interceptors)
+	return rc.retry.call(ctx, opts.attempts(&rc.retry, &rc.idempotent), opts.timeout, func(ctx context.Context) error {
+		return invoker(ctx, opts.name, params, result)
+	})
+}
+
+func (rc *ReconnectClient) callRemote(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	for {
+		r, err := rc.wait(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = r.Client.CallRemoteContext(ctx, method, params, result)
+		if err != ErrDisconnected || rc.policy != RetryPending {
+			return err
+		}
+	}
+}
+
+// Send a notification of the remote method once it's connected.
+func (rc *ReconnectClient) Notify(method string, params []interface{}) error {
+	ctx := context.Background()
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	r, err := rc.wait(ctx)
+	if err != nil {
+		return err
+	}
+	return r.Client.Notify(method, params)
+}
+
+// A stream is never called again, it ends if the connection is lost.
+func (rc *ReconnectClient) callStream(ctx context.Context, method string, params []interface{}, elemType reflect.Type) (reflect.Value, error) {
+	waitCtx := ctx
+	if _, ok := ctx.Deadline(); !ok && rc.timeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	r, err := rc.wait(waitCtx)
+	if err != nil {
+		return reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elemType), 0), err
+	}
+	return r.Client.callStream(ctx, method, params, elemType)
+}
+
+// Wait for the connection, and start connecting on the first call.
+func (rc *ReconnectClient) wait(ctx context.Context) (*Rpc, error) {
+	rc.start.Do(func() {
+		go rc.run()
+	})
+
+	for {
+		rc.lock.Lock()
+		r, changed := rc.rpc, rc.changed
+		rc.lock.Unlock()
+		if r != nil {
+			select {
+			case <-r.Done(): // lost, wait for the next one
+			default:
+				return r, nil
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-rc.closed:
+			return nil, ErrClientClosed
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrTimeout
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Dial and wait for the connection to be lost, until closed.
+func (rc *ReconnectClient) run() {
+	defer close(rc.exited)
+	defer rc.setState(StateClosed, nil)
+
+	var attempt int
+	for {
+		rc.setState(StateConnecting, nil)
+		r, err := rc.connect()
+		if err == ErrClientClosed {
+			return
+		}
+		if err != nil {
+			rc.setState(StateDisconnected, err)
+
+			select {
+			case <-time.After(backoff(rc.minBackoff, rc.maxBackoff, attempt)):
+			case <-rc.closed:
+				return
+			}
+			attempt += 1
+			continue
+		}
+		attempt = 0
+
+		rc.setState(StateConnected, nil)
+
+		select {
+		case <-r.Done():
+		case <-rc.closed:
+			r.Close()
+			<-r.Done()
+		}
+
+		rc.lock.Lock()
+		rc.setRpc(nil)
+		rc.lock.Unlock()
+
+		select {
+		case <-rc.closed:
+			return
+		default:
+		}
+		rc.setState(StateDisconnected, r.Err())
+	}
+}
+
+// Dial a connection and make it the current one.
+func (rc *ReconnectClient) connect() (*Rpc, error) {
+	r, err := rc.dialRpc()
+	if err != nil {
+		return nil, err
+	}
+	r.Client.SetTimeout(rc.timeout)
+
+	if rc.onConn != nil {
+		rc.onConn(r)
+	}
+
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+
+	select {
+	case <-rc.closed:
+		r.Close()
+		return nil, ErrClientClosed
+	default:
+	}
+
+	for _, f := range rc.funcs {
+		err = codecRegisterFuncTypes(r.codec, f)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	rc.setRpc(r)
+	return r, nil
+}
+
+// Dial by the func of SetDial if any, or by dialer with the timeout of calls,
+// which is stopped by Close.
+func (rc *ReconnectClient) dialRpc() (*Rpc, error) {
+	if rc.dial != nil {
+		return rc.dial(rc.network, rc.address)
+	}
+
+	ctx := rc.dialCtx
+	if rc.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rc.timeout)
+		defer cancel()
+	}
+
+	conn, err := rc.dialer(ctx, rc.network, rc.address)
+	if err != nil {
+		if rc.dialCtx.Err() != nil {
+			return nil, ErrClientClosed
+		}
+		return nil, err
+	}
+	return NewRpc(conn), nil
+}
+
+// Change the current connection, with the lock held.
+func (rc *ReconnectClient) setRpc(r *Rpc) {
+	rc.rpc = r
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+}
+
+func (rc *ReconnectClient) setState(state ConnState, err error) {
+	if rc.onState != nil {
+		rc.onState(state, err)
+	}
+}
@@ -0,0 +1,235 @@
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// registry holds the funcs registered by method, the interceptors, the ACL
+// and the RateLimiter. A registry of a connection inherits the ones of its
+// parent, which is shared by the connections of a Service.
+type registry struct {
+	parent *registry
+
+	funcs map[string]reflect.Value
+	lock  sync.RWMutex
+
+	interceptors       []Interceptor            // of all methods
+	methodInterceptors map[string][]Interceptor // by method
+	overrides          map[string][]Interceptor // by method, in place of all others
+
+	acl     *ACL
+	limiter *RateLimiter
+}
+
+func newRegistry(parent *registry) *registry {
+	r := new(registry)
+	r.parent = parent
+	r.funcs = make(map[string]reflect.Value)
+	r.methodInterceptors = make(map[string][]Interceptor)
+	r.overrides = make(map[string][]Interceptor)
+	return r
+}
+
+func (r *registry) register(method string, f reflect.Value) error {
+	if _, ok := r.lookup(method); ok {
+		return fmt.Errorf("method has been registered")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.funcs[method]; ok {
+		return fmt.Errorf("method has been registered")
+	}
+	r.funcs[method] = f
+	return nil
+}
+
+func (r *registry) unregister(method string) {
+	r.lock.Lock()
+	delete(r.funcs, method)
+	r.lock.Unlock()
+}
+
+// Find the func of method, in this registry first, then in the parents.
+func (r *registry) lookup(method string) (reflect.Value, bool) {
+	for ; r != nil; r = r.parent {
+		r.lock.RLock()
+		f, ok := r.funcs[method]
+		r.lock.RUnlock()
+		if ok {
+			return f, true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Add interceptors of method, or of all methods if method is empty.
+func (r *registry) use(method string, ics []Interceptor) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if method == "" {
+		r.interceptors = append(r.interceptors, ics...)
+	} else {
+		r.methodInterceptors[method] = append(r.methodInterceptors[method], ics...)
+	}
+}
+
+// Set the only interceptors of method, which may be none.
+func (r *registry) override(method string, ics []Interceptor) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.overrides[method] = append([]Interceptor{}, ics...)
+}
+
+// The interceptors of method in order, the ones of all methods first, and
+// the ones of the parents before the ones of the children. If method is
+// overridden, they're the ones of the nearest override.
+func (r *registry) chain(method string) []Interceptor {
+	for p := r; p != nil; p = p.parent {
+		p.lock.RLock()
+		ics, ok := p.overrides[method]
+		p.lock.RUnlock()
+		if ok {
+			return ics
+		}
+	}
+
+	var regs []*registry
+	for ; r != nil; r = r.parent {
+		regs = append([]*registry{r}, regs...)
+	}
+
+	var all, own []Interceptor
+	for _, r := range regs {
+		r.lock.RLock()
+		all = append(all, r.interceptors...)
+		own = append(own, r.methodInterceptors[method]...)
+		r.lock.RUnlock()
+	}
+	return append(all, own...)
+}
+
+func (r *registry) setACL(acl *ACL) {
+	r.lock.Lock()
+	r.acl = acl
+	r.lock.Unlock()
+}
+
+// The ACL of this registry, or of the nearest parent if it has none.
+func (r *registry) getACL() *ACL {
+	for ; r != nil; r = r.parent {
+		r.lock.RLock()
+		acl := r.acl
+		r.lock.RUnlock()
+		if acl != nil {
+			return acl
+		}
+	}
+	return nil
+}
+
+func (r *registry) setLimiter(limiter *RateLimiter) {
+	r.lock.Lock()
+	r.limiter = limiter
+	r.lock.Unlock()
+}
+
+// The RateLimiter of this registry, or of the nearest parent if it has none.
+func (r *registry) getLimiter() *RateLimiter {
+	for ; r != nil; r = r.parent {
+		r.lock.RLock()
+		limiter := r.limiter
+		r.lock.RUnlock()
+		if limiter != nil {
+			return limiter
+		}
+	}
+	return nil
+}
+
+// All funcs of this registry, without the parents.
+func (r *registry) all() []reflect.Value {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	fs := make([]reflect.Value, 0, len(r.funcs))
+	for _, f := range r.funcs {
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+///////////////////////////////////////////////////////////
+
+// Register the public methods of object by registerFunc.
+func registerObject(object interface{}, registerFunc func(string, interface{}) error) error {
+	t := reflect.TypeOf(object)
+	v := reflect.ValueOf(object)
+
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("'object' must be a point of struct")
+	}
+
+	var count int
+	for i := 0; i < t.NumMethod(); i++ {
+		mt := t.Method(i)
+		mv := v.Method(i)
+
+		// find a public method
+		if mt.PkgPath != "" || !mv.CanInterface() {
+			continue
+		}
+
+		// register
+		err := registerFunc(mt.Name, mv.Interface())
+		if err != nil {
+			return err
+		}
+
+		count += 1
+	}
+
+	if count <= 0 {
+		return fmt.Errorf("Register object has no method")
+	}
+
+	return nil
+}
+
+// Check that f can be registered as method.
+func checkFunc(method string, f interface{}) (err error) {
+	if method == "" {
+		return fmt.Errorf("method name is empty")
+	}
+	if f == nil {
+		return fmt.Errorf("func is nil")
+	}
+
+	t := reflect.TypeOf(f)
+
+	// f must be a Func
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("'%v' is not a function", method)
+	}
+
+	// f must return error as last param
+	nOut := t.NumOut()
+	if nOut == 0 || t.Out(nOut-1).Kind() != reflect.Interface {
+		err = fmt.Errorf("must return error as the last output param")
+		return
+	}
+	_, b := t.Out(nOut - 1).MethodByName("Error")
+	if !b {
+		err = fmt.Errorf("must return error as the last output param")
+		return
+	}
+
+	// a stream must be readable
+	if nOut > 1 && t.Out(0).Kind() == reflect.Chan && t.Out(0).ChanDir() == reflect.SendDir {
+		err = fmt.Errorf("must return a readable channel to stream")
+		return
+	}
+
+	return nil
+}
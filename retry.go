@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how the calls of idempotent methods are called again when
+// they fail. Other methods are never called again.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first one, no retry if <= 1
+	Backoff     time.Duration // before the first retry, doubled after each
+	MaxBackoff  time.Duration
+	Retryable   []error // errors to retry, an *Error matches the ones of its code
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond * 50,
+	MaxBackoff:  time.Second,
+	Retryable:   []error{ErrDisconnected, ErrTimeout, ErrShuttingDown},
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	return matchError(p.Retryable, err)
+}
+
+// Whether err is one of errs, an *Error matches the ones of its code.
+func matchError(errs []error, err error) bool {
+	if err == nil {
+		return false
+	}
+	e, isError := err.(*Error)
+	for _, r := range errs {
+		if r == err {
+			return true
+		}
+		if re, ok := r.(*Error); ok && isError && re.Code == e.Code {
+			return true
+		}
+	}
+	return false
+}
+
+// Call invoke at most attempts times, while it fails with a retryable error
+// and ctx is not done. Each attempt has the timeout if it's not 0.
+func (p *RetryPolicy) call(ctx context.Context, attempts int, timeout time.Duration, invoke func(ctx context.Context) error) error {
+	for i := 0; ; i++ {
+		err := callTimeout(ctx, timeout, invoke)
+		if i+1 >= attempts || !p.retryable(err) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff(p.Backoff, p.MaxBackoff, i)):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func callTimeout(ctx context.Context, timeout time.Duration, invoke func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return invoke(ctx)
+}
+
+// The time to wait before the next attempt, randomly in the upper half of
+// the exponential backoff from min to max.
+func backoff(min, max time.Duration, attempt int) time.Duration {
+	d := min
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// A set of method names, the zero value is empty.
+type methodSet struct {
+	lock    sync.RWMutex
+	methods map[string]bool
+}
+
+func (s *methodSet) add(methods ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.methods == nil {
+		s.methods = make(map[string]bool)
+	}
+	for _, method := range methods {
+		s.methods[method] = true
+	}
+}
+
+func (s *methodSet) has(method string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.methods[method]
+}
@@ -1,15 +1,23 @@
 package rpc
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
+	"reflect"
+	"sync"
 )
 
 type Rpc struct {
 	codec  Codec
 	Client *Client
 	Server *Server
+
+	done chan struct{}
+	err  error
+
+	peer *Peer // authenticated by the handshake
 }
 
 func Dial(network, address string) (*Rpc, error) {
@@ -34,11 +42,21 @@ func NewRpc(conn io.ReadWriteCloser) *Rpc {
 }
 
 func NewRpcWithCodec(codec Codec) *Rpc {
+	r := newRpc(codec, nil)
+	go r.run()
+	return r
+}
+
+// The Server of the Rpc also serves the methods of shared if it's not nil.
+// It's not started until r.run.
+func newRpc(codec Codec, shared *registry) *Rpc {
 	r := new(Rpc)
 	r.codec = codec
 	r.Client = newClientWithCodec(codec)
-	r.Server = newServerWithCodec(codec)
-	go r.run()
+	r.Server = newServerWithCodec(codec, shared)
+	r.Client.server = r.Server
+	r.Server.client = r.Client
+	r.done = make(chan struct{})
 	return r
 }
 
@@ -46,11 +64,76 @@ func (r *Rpc) Close() error {
 	return r.codec.Close()
 }
 
-func (r *Rpc) run() error {
+// Shutdown closes the connection gracefully. New requests are replied with
+// ErrShuttingDown, and new calls fail with it. It waits for the requests
+// being handled to reply and the pending calls to complete, until ctx is done,
+// then closes the connection. The callbacks of the pending calls are still
+// served meanwhile.
+func (r *Rpc) Shutdown(ctx context.Context) error {
+	errs := make(chan error, 2)
+	go func() {
+		errs <- r.Server.drain(ctx)
+	}()
+	go func() {
+		errs <- r.Client.drain(ctx)
+	}()
+
+	err := <-errs
+	if e := <-errs; err == nil {
+		err = e
+	}
+
+	r.Close()
+	return err
+}
+
+// Peer returns the identity of the other side authenticated by the
+// handshake, or nil.
+func (r *Rpc) Peer() *Peer {
+	return r.peer
+}
+
+// Register the type of v to the codec, for the items of streams received,
+// which are not in the signatures of the funcs. It's needed by GobCodec
+// before the first item of the type is received.
+func (r *Rpc) RegisterType(v interface{}) error {
+	return r.codec.RegisterType(v)
+}
+
+// Before it's started.
+func (r *Rpc) setPeer(peer *Peer) {
+	r.peer = peer
+	r.Server.ctx = context.WithValue(r.Server.ctx, peerKey{}, peer)
+}
+
+// Done returns a channel that's closed when the connection is ended.
+func (r *Rpc) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns why the connection is ended, or nil if it's not.
+func (r *Rpc) Err() error {
+	select {
+	case <-r.done:
+		return r.err
+	default:
+		return nil
+	}
+}
+
+func (r *Rpc) run() (err error) {
+	defer func() {
+		r.err = err
+		r.codec.Close()
+		r.Client.close()  // fail pending calls
+		r.Server.cancel() // cancel the context of running handlers
+		close(r.done)
+	}()
+
 	for {
 		req, resp, err := r.codec.Read()
 		if err != nil {
-			break
+			return err
 		}
 
 		if req != nil {
@@ -59,32 +142,66 @@ func (r *Rpc) run() error {
 			err = r.Client.onResponse(resp)
 		}
 		if err != nil {
-			break
+			return err
 		}
 	}
-	return nil
 }
 
 ///////////////////////////////////////////////////////////
 
+// Wait for wg until ctx is done.
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// A func param of this type is passed locally and never sent on the wire.
+var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 var (
-	CodeParseError     = -32700
-	CodeInvalidRequest = -32600
-	CodeMethodNotFound = -32601
-	CodeInvalidParams  = -32602
-	CodeInternalError  = -32603
-	CodeFunctionError  = -32604
+	CodeParseError       = -32700
+	CodeInvalidRequest   = -32600
+	CodeMethodNotFound   = -32601
+	CodeInvalidParams    = -32602
+	CodeInternalError    = -32603
+	CodeFunctionError    = -32604
+	CodeShuttingDown     = -32000
+	CodeDeadline         = -32001
+	CodePermissionDenied = -32002
+	CodeRateLimited      = -32003
+	CodeServerBusy       = -32004
 )
 
 var (
-	ErrDisconnected = errors.New("disconnected")
-	ErrTimeout      = errors.New("timeout")
+	ErrDisconnected  = errors.New("disconnected")
+	ErrTimeout       = errors.New("timeout")
+	ErrCanceled      = errors.New("canceled")
+	ErrStreamClosed  = errors.New("stream closed")
+	ErrServiceClosed = errors.New("service closed")
+	ErrClientClosed  = errors.New("client closed")
+	ErrAuthFailed    = errors.New("authentication failed")
+	ErrCircuitOpen   = errors.New("circuit open")
 )
 
 var (
-	ErrParseError     = NewError(CodeParseError, "parse error")
-	ErrInvalidRequest = NewError(CodeInvalidRequest, "invalid request")
-	ErrMethodNotFound = NewError(CodeMethodNotFound, "method not found")
-	ErrInvalidParams  = NewError(CodeInvalidParams, "invalid params")
-	ErrInternalError  = NewError(CodeInternalError, "internal error")
+	ErrParseError       = NewError(CodeParseError, "parse error")
+	ErrInvalidRequest   = NewError(CodeInvalidRequest, "invalid request")
+	ErrMethodNotFound   = NewError(CodeMethodNotFound, "method not found")
+	ErrInvalidParams    = NewError(CodeInvalidParams, "invalid params")
+	ErrInternalError    = NewError(CodeInternalError, "internal error")
+	ErrShuttingDown     = NewError(CodeShuttingDown, "shutting down")
+	ErrDeadline         = NewError(CodeDeadline, "deadline exceeded")
+	ErrPermissionDenied = NewError(CodePermissionDenied, "permission denied")
+	ErrRateLimited      = NewError(CodeRateLimited, "rate limited")
+	ErrServerBusy       = NewError(CodeServerBusy, "server busy")
 )
@@ -1,10 +1,24 @@
 package rpc
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
+	"log"
+	"math/big"
 	"net"
+	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -177,3 +191,2384 @@ func newTestConn() (net.Conn, net.Conn, error) {
 
 	return cliConn, svrConn, nil
 }
+
+/////////////////////////////////////////////////////////////////
+
+func TestRpcConcurrentRequests(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	block := make(chan struct{})
+	err = svrRpc.Server.RegisterFunc("slow", func() error {
+		<-block
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("fast", func(s string) (string, error) {
+		return s, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	slowDone := make(chan error, 1)
+	go func() {
+		slowDone <- cliRpc.Client.CallRemote("slow", nil, nil)
+	}()
+
+	// the slow handler must not block other requests
+	err = callAndCheck(cliRpc, "fast", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	close(block)
+	if err = <-slowDone; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRpcMaxWorkers(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	svrRpc.Server.SetMaxWorkers(1)
+
+	var lock sync.Mutex
+	var running, peak int
+	err = svrRpc.Server.RegisterFunc("work", func() error {
+		lock.Lock()
+		running += 1
+		if running > peak {
+			peak = running
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond * 20)
+
+		lock.Lock()
+		running -= 1
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := cliRpc.Client.CallRemote("work", nil, nil); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Fatal("max workers not respected", peak)
+	}
+}
+
+/////////////////////////////////////////////////////////////////
+
+func TestRpcContext(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	canceled := make(chan struct{}, 10)
+	err = svrRpc.Server.RegisterFunc("Wait", func(ctx context.Context, d int) (int, error) {
+		select {
+		case <-time.After(time.Duration(d) * time.Millisecond):
+		case <-ctx.Done():
+			canceled <- struct{}{}
+			return 0, ctx.Err()
+		}
+		return d, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var cli struct {
+		Wait func(ctx context.Context, d int) (int, error)
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret, err := cli.Wait(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != 10 {
+		t.Fatal("not match", ret)
+	}
+
+	// deadline of ctx
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	_, err = cli.Wait(ctx, 1000)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+
+	// canceled ctx
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = cliRpc.Client.CallRemoteContext(ctx, "Wait", []interface{}{1000}, nil)
+	if err != context.Canceled {
+		t.Fatal("expect canceled", err)
+	}
+
+	// handlers' context is canceled when the connection is closed
+	svrRpc.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler context not canceled")
+	}
+}
+
+func TestRpcCancel(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	stopped := make(chan error, 1)
+	err = svrRpc.Server.RegisterFunc("work", func(ctx context.Context) error {
+		select {
+		case <-ctx.Done():
+			stopped <- ctx.Err()
+		case <-time.After(time.Second):
+			stopped <- nil
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	err = cliRpc.Client.CallRemoteContext(ctx, "work", nil, nil)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+
+	// the handler is stopped by the deadline, or canceled by the client
+	if err = <-stopped; err != context.Canceled && err != context.DeadlineExceeded {
+		t.Fatal("handler not stopped", err)
+	}
+
+	// the handler is canceled by the client
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-time.After(time.Millisecond * 20)
+		cancel()
+	}()
+	err = cliRpc.Client.CallRemoteContext(ctx, "work", nil, nil)
+	if err != context.Canceled {
+		t.Fatal("expect canceled", err)
+	}
+	if err = <-stopped; err != context.Canceled {
+		t.Fatal("handler not canceled", err)
+	}
+}
+
+func TestRpcDisconnect(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	cliRpc.Client.SetTimeout(0)
+
+	err = svrRpc.Server.RegisterFunc("block", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret := make(chan error, 1)
+	go func() {
+		ret <- cliRpc.Client.CallRemote("block", nil, nil)
+	}()
+
+	<-time.After(time.Millisecond * 10)
+	svrRpc.Close()
+
+	// pending call fails
+	select {
+	case err = <-ret:
+		if err != ErrDisconnected {
+			t.Fatal("expect disconnected", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending call not failed")
+	}
+
+	select {
+	case <-cliRpc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not done")
+	}
+	if cliRpc.Err() == nil {
+		t.Fatal("expect error")
+	}
+
+	// calls after
+	err = cliRpc.Client.CallRemote("block", nil, nil)
+	if err != ErrDisconnected {
+		t.Fatal("expect disconnected", err)
+	}
+}
+
+func TestRpcNotify(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	got := make(chan string, 2)
+	err = svrRpc.Server.RegisterFunc("Log", func(s string) error {
+		got <- s
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var cli struct {
+		Log func(s string) error `rpc:"notify"`
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = cli.Log("foo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = cliRpc.Client.Notify("Log", []interface{}{"bar"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var received = make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case s := <-got:
+			received[s] = true
+		case <-time.After(time.Second):
+			t.Fatal("notification not received")
+		}
+	}
+	if !received["foo"] || !received["bar"] {
+		t.Fatal("not match", received)
+	}
+
+	// a notification must return error only
+	var bad struct {
+		Log func(s string) (string, error) `rpc:"notify"`
+	}
+	if err = cliRpc.Client.MakeClient(&bad); err == nil {
+		t.Fatal("expect error")
+	}
+}
+
+func TestRpcGo(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.RegisterFunc("double", func(a int) (int, error) {
+		return a * 2, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("block", func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// fan out
+	var n = 20
+	done := make(chan *Call, n)
+	for i := 0; i < n; i++ {
+		cliRpc.Client.Go("double", []interface{}{i}, new(int), done)
+	}
+	for i := 0; i < n; i++ {
+		call := <-done
+		if call.Error != nil {
+			t.Fatal(call.Error.Error())
+		}
+		a := call.Params[0].(int)
+		if ret := *call.Result.(*int); ret != a*2 {
+			t.Fatal("not match", a, ret)
+		}
+	}
+
+	// abort
+	call := cliRpc.Client.Go("block", nil, nil, nil)
+	cliRpc.Client.Abort(call)
+	call = <-call.Done
+	if call.Error != ErrCanceled {
+		t.Fatal("expect canceled", call.Error)
+	}
+
+	// a completion over the buffer of done is logged
+	logs := make(chanWriter, 1)
+	log.SetOutput(logs)
+	defer log.SetOutput(os.Stderr)
+	done = make(chan *Call, 1)
+	cliRpc.Client.Go("double", []interface{}{1}, new(int), done)
+	cliRpc.Client.Go("double", []interface{}{2}, new(int), done)
+	select {
+	case <-logs:
+	case <-time.After(time.Second):
+		t.Fatal("expect logged")
+	}
+	<-done
+}
+
+// chanWriter sends each write to the channel, or drops it if it's full.
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	select {
+	case w <- string(p):
+	default:
+	}
+	return len(p), nil
+}
+
+func TestRpcBatch(t *testing.T) {
+	for _, newCodec := range []func(io.ReadWriteCloser) Codec{NewJsonCodec, NewGobCodec} {
+		cliConn, svrConn, err := newTestConn()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		cliRpc := NewRpcWithCodec(newCodec(cliConn))
+		svrRpc := NewRpcWithCodec(newCodec(svrConn))
+		svrRpc.Server.SetBatchParallel(true)
+
+		got := make(chan string, 1)
+		err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+			return a + b, nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = svrRpc.Server.RegisterFunc("log", func(s string) error {
+			got <- s
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		var r1, r2 int
+		b := cliRpc.Client.Batch()
+		c1 := b.Call("add", []interface{}{1, 2}, &r1)
+		c2 := b.Call("add", []interface{}{3, 4}, &r2)
+		c3 := b.Call("sub", []interface{}{3, 4}, nil)
+		b.Notify("log", []interface{}{"foo"})
+
+		err = b.Do()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if c1.Error != nil || c2.Error != nil {
+			t.Fatal(c1.Error, c2.Error)
+		}
+		if r1 != 3 || r2 != 7 {
+			t.Fatal("not match", r1, r2)
+		}
+		if !reflect.DeepEqual(c3.Error, ErrMethodNotFound) {
+			t.Fatal("expect method not found", c3.Error)
+		}
+		if call := <-c1.Done; call != c1 {
+			t.Fatal("call not in done")
+		}
+		if s := <-got; s != "foo" {
+			t.Fatal("not match", s)
+		}
+
+		// an empty batch doesn't end the connection
+		err = cliRpc.codec.WriteRequest(&Request{kind: kindBatch})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = callAndCheck(cliRpc, "add", []interface{}{1, 2}, 3, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		cliRpc.Close()
+		svrRpc.Close()
+	}
+}
+
+func TestRpcBatchLimits(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	svrRpc.Server.SetBatchParallel(true)
+	svrRpc.Server.SetMaxWorkers(2)
+
+	var lock sync.Mutex
+	var running, peak int
+	err = svrRpc.Server.RegisterFunc("work", func() error {
+		lock.Lock()
+		running += 1
+		if running > peak {
+			peak = running
+		}
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond * 10)
+
+		lock.Lock()
+		running -= 1
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// in parallel by the workers of the connection
+	b := cliRpc.Client.Batch()
+	for i := 0; i < 6; i++ {
+		b.Call("work", nil, nil)
+	}
+	if err = b.Do(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if peak != 2 {
+		t.Fatal("max workers not respected", peak)
+	}
+
+	// too large
+	svrRpc.Server.SetMaxBatch(2)
+	b = cliRpc.Client.Batch()
+	calls := []*Call{b.Call("work", nil, nil), b.Call("work", nil, nil), b.Call("work", nil, nil)}
+	if err = b.Do(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, call := range calls {
+		if !reflect.DeepEqual(call.Error, ErrInvalidRequest) {
+			t.Fatal("expect invalid request", call.Error)
+		}
+	}
+}
+
+func TestRpcInvalidBatch(t *testing.T) {
+	cliConn, svrConn, err := newTestConn()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	svrRpc := NewRpc(svrConn)
+	defer svrRpc.Close()
+	defer cliConn.Close()
+
+	err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// replied a single error, not an array
+	dec := json.NewDecoder(cliConn)
+	var reply map[string]interface{}
+	_, err = cliConn.Write([]byte("[]\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = dec.Decode(&reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	e, _ := reply["error"].(map[string]interface{})
+	if e == nil || e["code"] != float64(CodeInvalidRequest) || reply["id"] != nil {
+		t.Fatal("expect invalid request", reply)
+	}
+
+	// still served
+	_, err = cliConn.Write([]byte(`{"id":1,"method":"add","params":[1,2]}` + "\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reply = nil
+	err = dec.Decode(&reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if reply["id"] != float64(1) || reply["result"] != float64(3) {
+		t.Fatal("not match", reply)
+	}
+
+	// an invalid request of a batch is replied an error
+	_, err = cliConn.Write([]byte(`[1,{"id":2,"method":"add","params":[1,2]}]` + "\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var replies []map[string]interface{}
+	err = dec.Decode(&replies)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(replies) != 2 {
+		t.Fatal("not match", replies)
+	}
+	e, _ = replies[0]["error"].(map[string]interface{})
+	if e == nil || e["code"] != float64(CodeInvalidRequest) || replies[0]["id"] != nil {
+		t.Fatal("expect invalid request", replies[0])
+	}
+	if replies[1]["id"] != float64(2) || replies[1]["result"] != float64(3) {
+		t.Fatal("not match", replies[1])
+	}
+
+	// so is an invalid request not in a batch
+	_, err = cliConn.Write([]byte("5\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	reply = nil
+	err = dec.Decode(&reply)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	e, _ = reply["error"].(map[string]interface{})
+	if e == nil || e["code"] != float64(CodeInvalidRequest) {
+		t.Fatal("expect invalid request", reply)
+	}
+}
+
+func TestRpcServerStream(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	stopped := make(chan struct{}, 1)
+	err = svrRpc.Server.RegisterFunc("Count", func(ctx context.Context, n int) (<-chan fooType, error) {
+		if n < 0 {
+			return nil, fmt.Errorf("negative")
+		}
+		ch := make(chan fooType)
+		go func() {
+			defer close(ch)
+			for i := 0; n == 0 || i < n; i++ {
+				select {
+				case ch <- fooType{"foo", float64(i)}:
+				case <-ctx.Done():
+					stopped <- struct{}{}
+					return
+				}
+			}
+		}()
+		return ch, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var cli struct {
+		Count func(ctx context.Context, n int) (<-chan fooType, error)
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// more items than the window
+	ch, err := cli.Count(context.Background(), streamWindow*3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var i int
+	for item := range ch {
+		if item.Point != float64(i) {
+			t.Fatal("not match", item, i)
+		}
+		i += 1
+	}
+	if i != streamWindow*3 {
+		t.Fatal("count not match", i)
+	}
+
+	// error of handler
+	_, err = cli.Count(context.Background(), -1)
+	if err == nil || err.Error() != "negative" {
+		t.Fatal("expect error", err)
+	}
+
+	// cancel an endless stream
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err = cli.Count(ctx, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-ch
+	<-ch
+
+	// a stalled stream never blocks other calls
+	time.Sleep(time.Millisecond * 10)
+	_, err = cli.Count(context.Background(), -1)
+	if err == nil {
+		t.Fatal("expect error")
+	}
+
+	cancel()
+	for range ch {
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stream not canceled on server")
+	}
+}
+
+type streamPoint struct {
+	X, Y int
+}
+
+type namedPoint struct {
+	X, Y int
+}
+
+func TestRpcStream(t *testing.T) {
+	gob.RegisterName("test.namedPoint", namedPoint{}) // not by the name of Register
+
+	for _, newCodec := range []func(io.ReadWriteCloser) Codec{NewJsonCodec, NewGobCodec} {
+		cliConn, svrConn, err := newTestConn()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		cliRpc := NewRpcWithCodec(newCodec(cliConn))
+		svrRpc := NewRpcWithCodec(newCodec(svrConn))
+
+		// upload
+		err = svrRpc.Server.RegisterFunc("sum", func(s *Stream) (int, error) {
+			var sum int
+			for {
+				var n int
+				err := s.Recv(&n)
+				if err == io.EOF {
+					return sum, nil
+				}
+				if err != nil {
+					return 0, err
+				}
+				sum += n
+			}
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// chat
+		err = svrRpc.Server.RegisterFunc("echo", func(prefix string, s *Stream) error {
+			for {
+				var msg string
+				err := s.Recv(&msg)
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if err = s.Send(prefix + msg); err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+			return a + b, nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// items of a type not in the signature
+		err = svrRpc.Server.RegisterFunc("points", func(n int, s *Stream) error {
+			for i := 0; i < n; i++ {
+				if err := s.Send(streamPoint{X: i, Y: -i}); err != nil {
+					return err
+				}
+			}
+			return s.Send(namedPoint{X: n})
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		st, err := cliRpc.Client.OpenStreamContext(context.Background(), "points", []interface{}{3})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := 0; i < 3; i++ {
+			var p streamPoint
+			if err = st.Recv(&p); err != nil {
+				t.Fatal(err.Error())
+			}
+			if p != (streamPoint{X: i, Y: -i}) {
+				t.Fatal("not match", p)
+			}
+		}
+		var np namedPoint
+		if err = st.Recv(&np); err != nil {
+			t.Fatal(err.Error())
+		}
+		if np != (namedPoint{X: 3}) {
+			t.Fatal("not match", np)
+		}
+		if err = st.Wait(nil); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		st, err = cliRpc.Client.OpenStream("sum")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var expect int
+		for i := 0; i < streamWindow*3; i++ {
+			if err = st.Send(i); err != nil {
+				t.Fatal(err.Error())
+			}
+			expect += i
+		}
+		if err = st.CloseSend(); err != nil {
+			t.Fatal(err.Error())
+		}
+		var sum int
+		if err = st.Wait(&sum); err != nil {
+			t.Fatal(err.Error())
+		}
+		if sum != expect {
+			t.Fatal("not match", sum, expect)
+		}
+
+		st, err = cliRpc.Client.OpenStreamContext(context.Background(), "echo", []interface{}{"re: "})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, msg := range []string{"foo", "bar"} {
+			if err = st.Send(msg); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			// multiplexed with other calls
+			if err = callAndCheck(cliRpc, "add", []interface{}{1, 2}, 3, nil); err != nil {
+				t.Fatal(err.Error())
+			}
+
+			var reply string
+			if err = st.Recv(&reply); err != nil {
+				t.Fatal(err.Error())
+			}
+			if reply != "re: "+msg {
+				t.Fatal("not match", reply)
+			}
+		}
+		st.CloseSend()
+		var reply string
+		if err = st.Recv(&reply); err != io.EOF {
+			t.Fatal("expect EOF", err)
+		}
+		if err = st.Wait(nil); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// not found
+		_, err = cliRpc.Client.OpenStream("nothing")
+		if !reflect.DeepEqual(err, ErrMethodNotFound) {
+			t.Fatal("expect method not found", err)
+		}
+
+		cliRpc.Close()
+		svrRpc.Close()
+	}
+}
+
+func TestRpcCallback(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.RegisterFunc("Each", func(items []string, f func(i int, s string) (string, error)) (string, error) {
+		if f == nil {
+			return "nil", nil
+		}
+		var ret string
+		for i, s := range items {
+			r, err := f(i, s)
+			if err != nil {
+				return "", err
+			}
+			ret += r
+		}
+		return ret, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var cli struct {
+		Each func(items []string, f func(i int, s string) (string, error)) (string, error)
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret, err := cli.Each([]string{"a", "b", "c"}, func(i int, s string) (string, error) {
+		return fmt.Sprintf("%v%v", s, i), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != "a0b1c2" {
+		t.Fatal("not match", ret)
+	}
+
+	// error of callback
+	_, err = cli.Each([]string{"a"}, func(i int, s string) (string, error) {
+		return "", fmt.Errorf("stop")
+	})
+	if err == nil || err.Error() != "stop" {
+		t.Fatal("expect error", err)
+	}
+
+	// nil func
+	ret, err = cli.Each([]string{"a"}, nil)
+	if err != nil || ret != "nil" {
+		t.Fatal("not match", ret, err)
+	}
+
+	// released once the call completes
+	n := len(cliRpc.Server.reg.all())
+	if n != 0 {
+		t.Fatal("callbacks not released", n)
+	}
+
+	// only the callbacks registered by the client are exempted from the ACL
+	acl := NewACL()
+	acl.Allow("*")
+	cliRpc.Server.SetACL(acl)
+	ret, err = cli.Each([]string{"a"}, func(i int, s string) (string, error) {
+		return s, nil
+	})
+	if err != nil || ret != "a" {
+		t.Fatal("not match", ret, err)
+	}
+	err = callAndCheck(svrRpc, "$callback.1", nil, nil, ErrPermissionDenied)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = cliRpc.Server.RegisterFunc("$callback.admin", func() error { return nil })
+	if err == nil {
+		t.Fatal("expect reserved name")
+	}
+}
+
+func TestRpcFullWorkers(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	svrRpc.Server.SetMaxWorkers(1)
+
+	err = svrRpc.Server.RegisterFunc("sum", func(s *Stream) (int, error) {
+		var sum int
+		for {
+			var n int
+			err := s.Recv(&n)
+			if err == io.EOF {
+				return sum, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			sum += n
+		}
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("Call", func(f func() (string, error)) (string, error) {
+		return f()
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// queue a call behind the one of the worker
+	queue := func() chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- callAndCheck(cliRpc, "add", []interface{}{1, 2}, 3, nil)
+		}()
+		time.Sleep(time.Millisecond * 20)
+		return done
+	}
+
+	// the frames of the stream are still read
+	st, err := cliRpc.Client.OpenStream("sum")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	queued := queue()
+	for i := 1; i <= 3; i++ {
+		if err = st.Send(i); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err = st.CloseSend(); err != nil {
+		t.Fatal(err.Error())
+	}
+	var sum int
+	if err = st.Wait(&sum); err != nil {
+		t.Fatal(err.Error())
+	}
+	if sum != 6 {
+		t.Fatal("not match", sum)
+	}
+	if err = <-queued; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the response of the callback is still read
+	release := make(chan struct{})
+	called := make(chan struct{})
+	var cli struct {
+		Call func(f func() (string, error)) (string, error)
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan error, 1)
+	go func() {
+		ret, err := cli.Call(func() (string, error) {
+			close(called)
+			<-release
+			return "ok", nil
+		})
+		if err == nil && ret != "ok" {
+			err = fmt.Errorf("not match %v", ret)
+		}
+		done <- err
+	}()
+	select {
+	case <-called:
+	case err = <-done:
+		t.Fatal("callback not called", err)
+	}
+	queued = queue()
+
+	// busy if the queue is full
+	svrRpc.Server.SetMaxQueue(1)
+	err = callAndCheck(cliRpc, "add", []interface{}{1, 2}, nil, ErrServerBusy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	close(release)
+	if err = <-done; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = <-queued; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRpcShutdown(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	started := make(chan struct{})
+	err = svrRpc.Server.RegisterFunc("slow", func(s string) (string, error) {
+		close(started)
+		time.Sleep(time.Millisecond * 50)
+		return s, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("fast", func(s string) (string, error) {
+		return s, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret := make(chan error, 1)
+	go func() {
+		ret <- callAndCheck(cliRpc, "slow", []interface{}{"abc"}, "abc", nil)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- svrRpc.Shutdown(context.Background())
+	}()
+	<-time.After(time.Millisecond * 10)
+
+	// new requests are refused
+	err = callAndCheck(cliRpc, "fast", []interface{}{"abc"}, nil, ErrShuttingDown)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Client.CallRemote("fast", nil, nil)
+	if !reflect.DeepEqual(err, ErrShuttingDown) {
+		t.Fatal("expect shutting down", err)
+	}
+
+	// the request being handled replies
+	if err = <-ret; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err.Error())
+	}
+
+	select {
+	case <-svrRpc.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+}
+
+func TestRpcShutdownCallback(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	defer svrRpc.Close()
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	err = svrRpc.Server.RegisterFunc("later", func(f func() (string, error)) (string, error) {
+		close(started)
+		<-proceed
+		return f()
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret := make(chan error, 1)
+	go func() {
+		var r string
+		err := cliRpc.Client.CallRemote("later", []interface{}{func() (string, error) {
+			return "ok", nil
+		}}, &r)
+		if err == nil && r != "ok" {
+			err = fmt.Errorf("not match %v", r)
+		}
+		ret <- err
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- cliRpc.Shutdown(context.Background())
+	}()
+	<-time.After(time.Millisecond * 10)
+
+	// the callback of the pending call is still served
+	close(proceed)
+	if err = <-ret; err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestService(t *testing.T) {
+	var err error
+	svc := NewService()
+	err = svc.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	conns := make(chan *Rpc, 2)
+	svc.OnConnect(func(r *Rpc) {
+		r.Server.SetMaxWorkers(8)
+		conns <- r
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svc.Serve(lis)
+	}()
+
+	var clis []*Rpc
+	for i := 0; i < 2; i++ {
+		cliRpc, err := Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		clis = append(clis, cliRpc)
+	}
+	svrRpc := <-conns
+	<-conns
+
+	if n := len(svc.Conns()); n != 2 {
+		t.Fatal("expect 2 conns", n)
+	}
+
+	// shared by all connections
+	err = svc.RegisterFunc("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, cliRpc := range clis {
+		err = callAndCheck(cliRpc, "Echo", []interface{}{"abc"}, "abc", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = callAndCheck(cliRpc, "add", []interface{}{1, 2}, 3, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// registered to one connection only
+	err = svrRpc.Server.RegisterFunc("local", func() (string, error) {
+		return "local", nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+		return 0, nil
+	})
+	if err == nil {
+		t.Fatal("expect registered error")
+	}
+	var okCount int
+	for _, cliRpc := range clis {
+		if callAndCheck(cliRpc, "local", nil, "local", nil) == nil {
+			okCount += 1
+		}
+	}
+	if okCount != 1 {
+		t.Fatal("expect served on one connection", okCount)
+	}
+
+	// shut down
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = svc.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = <-served; err != ErrServiceClosed {
+		t.Fatal("expect service closed", err)
+	}
+	if n := len(svc.Conns()); n != 0 {
+		t.Fatal("expect no conns", n)
+	}
+	for _, cliRpc := range clis {
+		select {
+		case <-cliRpc.Done():
+		case <-time.After(time.Second):
+			t.Fatal("not closed")
+		}
+	}
+}
+
+func TestReconnectClient(t *testing.T) {
+	var err error
+	svc := NewService()
+	err = svc.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var calls int32
+	blocked := make(chan struct{}, 1)
+	err = svc.RegisterFunc("once", func(ctx context.Context) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 { // the first call is lost
+			blocked <- struct{}{}
+			<-ctx.Done()
+		}
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go svc.Serve(lis)
+	defer svc.Close()
+
+	var got []ConnState
+	states := make(chan ConnState, 100)
+	dropConns := func() {
+		for _, r := range svc.Conns() {
+			r.Close()
+		}
+		for state := range states {
+			got = append(got, state)
+			if state == StateDisconnected {
+				return
+			}
+		}
+	}
+
+	rc := NewReconnectClient("tcp", lis.Addr().String())
+	rc.SetBackoff(time.Millisecond*10, time.Millisecond*50)
+	rc.OnStateChange(func(state ConnState, err error) {
+		states <- state
+	})
+	defer rc.Close()
+
+	var cli = cliCaller{}
+	err = rc.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret, err := cli.Echo("abc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != "abc" {
+		t.Fatal("not match", ret)
+	}
+
+	// funcs keep working after reconnect
+	dropConns()
+	ret, err = cli.Echo("def")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != "def" {
+		t.Fatal("not match", ret)
+	}
+
+	// pending calls fail by default
+	errs := make(chan error, 1)
+	go func() {
+		errs <- rc.CallRemote("once", nil, nil)
+	}()
+	<-blocked
+	dropConns()
+	if err = <-errs; err != ErrDisconnected {
+		t.Fatal("expect disconnected", err)
+	}
+
+	// or retried on the next connection
+	atomic.StoreInt32(&calls, 0)
+	rc.SetPolicy(RetryPending)
+	var s string
+	go func() {
+		errs <- rc.CallRemote("once", nil, &s)
+	}()
+	<-blocked
+	dropConns()
+	if err = <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+	if s != "ok" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("not retried", s, calls)
+	}
+
+	rc.Close()
+	if err = rc.CallRemote("Echo", []interface{}{"abc"}, nil); err != ErrClientClosed {
+		t.Fatal("expect client closed", err)
+	}
+
+	for len(states) > 0 {
+		got = append(got, <-states)
+	}
+	expect := []ConnState{StateConnecting, StateConnected, StateDisconnected}
+	if len(got) < 4 || !reflect.DeepEqual(got[:3], expect) || got[len(got)-1] != StateClosed {
+		t.Fatal("states not match", got)
+	}
+}
+
+func TestRpcInterceptor(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("add", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var trace []string
+	var lock sync.Mutex
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+			lock.Lock()
+			trace = append(trace, name+":"+req.Method)
+			lock.Unlock()
+			return next(ctx, req)
+		}
+	}
+
+	svrRpc.Server.UseMethod("add", record("method"))
+	svrRpc.Server.Use(record("first"), record("second"))
+
+	// short-circuit
+	denied := NewError(-1, "denied")
+	svrRpc.Server.UseMethod("add", func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		var a int
+		if err := req.Param(0, &a); err != nil {
+			return nil, err
+		}
+		if a < 0 {
+			return nil, denied
+		}
+		return next(ctx, req)
+	})
+
+	err = callAndCheck(cliRpc, "add", []interface{}{1, 2}, 3, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := []string{"first:add", "second:add", "method:add"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatal("not match", trace, expect)
+	}
+
+	trace = nil
+	err = callAndCheck(cliRpc, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect = []string{"first:Echo", "second:Echo"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatal("not match", trace, expect)
+	}
+
+	err = callAndCheck(cliRpc, "add", []interface{}{-1, 2}, nil, denied)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// method not found passes the interceptors as well
+	trace = nil
+	err = callAndCheck(cliRpc, "none", nil, nil, ErrMethodNotFound)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect = []string{"first:none", "second:none"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatal("not match", trace, expect)
+	}
+
+	// override the interceptors of a method
+	svrRpc.Server.SetMethodInterceptors("add", record("only"))
+	trace = nil
+	err = callAndCheck(cliRpc, "add", []interface{}{-1, 2}, 1, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect = []string{"only:add"}
+	if !reflect.DeepEqual(trace, expect) {
+		t.Fatal("not match", trace, expect)
+	}
+
+	// exempt a method from all
+	svrRpc.Server.SetMethodInterceptors("Echo")
+	trace = nil
+	err = callAndCheck(cliRpc, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(trace) != 0 {
+		t.Fatal("expect not intercepted", trace)
+	}
+}
+
+func TestRpcClientInterceptor(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var failures int32 = 2
+	err = svrRpc.Server.RegisterFunc("flaky", func() (string, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return "", fmt.Errorf("try again")
+		}
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var methods []string
+	cliRpc.Client.Use(func(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error {
+		methods = append(methods, method)
+		return next(ctx, method, params, result)
+	})
+	// modify params
+	cliRpc.Client.Use(func(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error {
+		if method == "Echo" {
+			params = []interface{}{"hi " + params[0].(string)}
+		}
+		return next(ctx, method, params, result)
+	})
+	// retry
+	cliRpc.Client.Use(func(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error {
+		err := next(ctx, method, params, result)
+		for i := 0; i < 3 && err != nil && err.Error() == "try again"; i++ {
+			err = next(ctx, method, params, result)
+		}
+		return err
+	})
+
+	var cli = cliCaller{}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret, err := cli.Echo("abc")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ret != "hi abc" {
+		t.Fatal("not match", ret)
+	}
+
+	err = callAndCheck(cliRpc, "flaky", nil, "ok", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if !reflect.DeepEqual(methods, []string{"Echo", "flaky"}) {
+		t.Fatal("not match", methods)
+	}
+
+	// fail a call without sending it
+	stop := fmt.Errorf("stop")
+	cliRpc.Client.Use(func(ctx context.Context, method string, params []interface{}, result interface{}, next Invoker) error {
+		return stop
+	})
+	_, err = cli.Echo("abc")
+	if err != stop {
+		t.Fatal("expect stop", err)
+	}
+}
+
+func TestRpcHeader(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	var seen Header
+	svrRpc.Server.Use(func(ctx context.Context, req *Request, next Handler) (interface{}, error) {
+		seen = req.Header
+		return next(ctx, req)
+	})
+	err = svrRpc.Server.RegisterFunc("whoami", func(ctx context.Context) (string, error) {
+		SetTrailer(ctx, "served-by", "svr")
+		return HeaderFromContext(ctx)["user"], nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cliRpc.Client.SetHeader("user", "tom")
+	cliRpc.Client.SetHeader("tenant", "a")
+
+	var user string
+	trailer := Header{}
+	err = cliRpc.Client.CallRemoteContext(WithTrailer(context.Background(), trailer), "whoami", nil, &user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user != "tom" {
+		t.Fatal("not match", user)
+	}
+	if !reflect.DeepEqual(seen, Header{"user": "tom", "tenant": "a"}) {
+		t.Fatal("header not match", seen)
+	}
+	if !reflect.DeepEqual(trailer, Header{"served-by": "svr"}) {
+		t.Fatal("trailer not match", trailer)
+	}
+
+	// per call
+	ctx := WithHeader(context.Background(), "user", "jerry")
+	ctx = WithHeader(ctx, "trace", "1")
+	err = cliRpc.Client.CallRemoteContext(ctx, "whoami", nil, &user)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if user != "jerry" {
+		t.Fatal("not match", user)
+	}
+	if !reflect.DeepEqual(seen, Header{"user": "jerry", "tenant": "a", "trace": "1"}) {
+		t.Fatal("header not match", seen)
+	}
+
+	// async calls carry the trailers
+	call := <-cliRpc.Client.Go("whoami", nil, &user, nil).Done
+	if call.Error != nil {
+		t.Fatal(call.Error.Error())
+	}
+	if call.Trailer["served-by"] != "svr" {
+		t.Fatal("trailer not match", call.Trailer)
+	}
+}
+
+func TestRpcClientTags(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.RegisterFunc("Svc.Echo", func(s string) (string, error) {
+		return s, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var calls int32
+	err = svrRpc.Server.RegisterFunc("slow", func(ctx context.Context, n int) (int, error) {
+		if atomic.AddInt32(&calls, 1) <= int32(n) { // the first n calls time out
+			<-ctx.Done()
+		}
+		return n, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var cli struct {
+		Echo    func(s string) (string, error) `rpc:"name=Svc.Echo"`
+		Slow    func(n int) (int, error)       `rpc:"name=slow, timeout=20ms"`
+		Retry   func(n int) (int, error)       `rpc:"name=slow,timeout=20ms,retry=2"`
+		NoRetry func(n int) (int, error)       `rpc:"name=slow,timeout=20ms,retry=0"`
+		Publish func(s string) error           `rpc:"notify,name=Svc.Echo"`
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ret, err := cli.Echo("abc")
+	if err != nil || ret != "abc" {
+		t.Fatal("not match", ret, err)
+	}
+	if err = cli.Publish("abc"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	_, err = cli.Slow(1)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	n, err := cli.Retry(2)
+	if err != nil || n != 2 {
+		t.Fatal("not match", n, err)
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Fatal("expect 3 tries", calls)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.Retry(3)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+
+	// retry=0 is called once, even if the method is idempotent
+	cliRpc.Client.MarkIdempotent("slow")
+	atomic.StoreInt32(&calls, 0)
+	_, err = cli.NoRetry(1)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Fatal("expect 1 try", calls)
+	}
+
+	// malformed
+	tags := []interface{}{
+		&struct {
+			F func() error `rpc:"nofity"`
+		}{},
+		&struct {
+			F func() error `rpc:"timeout=2"`
+		}{},
+		&struct {
+			F func() error `rpc:"retry=-1"`
+		}{},
+		&struct {
+			F func() error `rpc:"name="`
+		}{},
+		&struct {
+			F func() error `rpc:"notify=true"`
+		}{},
+		&struct {
+			F func() error `rpc:"notify,retry=1"`
+		}{},
+		&struct {
+			F func() error `rpc:"name=a,name=b"`
+		}{},
+	}
+	for _, tag := range tags {
+		if err = cliRpc.Client.MakeClient(tag); err == nil {
+			t.Fatal("expect error", reflect.TypeOf(tag).Elem().Field(0).Tag)
+		}
+	}
+}
+
+func TestRpcDeadline(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+	svrRpc.Server.SetMaxWorkers(1)
+
+	err = svrRpc.Server.RegisterFunc("deadline", func(ctx context.Context) (time.Duration, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return 0, fmt.Errorf("no deadline")
+		}
+		return time.Until(deadline), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	release := make(chan struct{})
+	err = svrRpc.Server.RegisterFunc("busy", func() error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var handled int32
+	err = svrRpc.Server.RegisterFunc("queued", func() error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the handler gets the deadline of the caller
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var left time.Duration
+	err = cliRpc.Client.CallRemoteContext(ctx, "deadline", nil, &left)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if left <= time.Millisecond*500 || left > time.Second {
+		t.Fatal("deadline not match", left)
+	}
+
+	// a request expired while waiting for a worker is not handled
+	busy := cliRpc.Client.Go("busy", nil, nil, nil)
+	<-time.After(time.Millisecond * 10)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	err = cliRpc.Client.CallRemoteContext(ctx, "queued", nil, nil)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+	<-time.After(time.Millisecond * 20) // the server counts the deadline from when the request arrives
+
+	close(release)
+	<-busy.Done
+	err = callAndCheck(cliRpc, "queued", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatal("expired request handled", n)
+	}
+
+	// an expired context fails without sending
+	err = cliRpc.Client.CallRemoteContext(ctx, "queued", nil, nil)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+}
+
+func TestRpcRetryPolicy(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	busy := NewError(-1, "busy")
+	broken := NewError(-2, "broken")
+	var calls int32
+	failures := func(n int32, e *Error) func() (string, error) {
+		return func() (string, error) {
+			if atomic.AddInt32(&calls, 1) <= n {
+				return "", e
+			}
+			return "ok", nil
+		}
+	}
+	err = svrRpc.Server.RegisterFunc("busy", failures(2, busy))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svrRpc.Server.RegisterFunc("broken", failures(1, broken))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	policy := DefaultRetryPolicy
+	policy.Backoff = time.Millisecond
+	policy.Retryable = append(policy.Retryable, busy)
+	cliRpc.Client.SetRetryPolicy(policy)
+
+	// not idempotent
+	err = callAndCheck(cliRpc, "busy", nil, nil, busy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// idempotent
+	atomic.StoreInt32(&calls, 0)
+	cliRpc.Client.MarkIdempotent("busy", "broken")
+	err = callAndCheck(cliRpc, "busy", nil, "ok", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatal("expect 3 attempts", n)
+	}
+
+	// never retried after an error not retryable
+	atomic.StoreInt32(&calls, 0)
+	err = callAndCheck(cliRpc, "broken", nil, nil, broken)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatal("expect 1 attempt", n)
+	}
+
+	// at most MaxAttempts
+	atomic.StoreInt32(&calls, -5)
+	err = callAndCheck(cliRpc, "busy", nil, nil, busy)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt32(&calls); n != -2 {
+		t.Fatal("expect 3 attempts", n)
+	}
+
+	// marked by tag
+	var cli struct {
+		Busy func() (string, error) `rpc:"name=busy,idempotent"`
+	}
+	err = cliRpc.Client.MakeClient(&cli)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	atomic.StoreInt32(&calls, 0)
+	ret, err := cli.Busy()
+	if err != nil || ret != "ok" {
+		t.Fatal("not match", ret, err)
+	}
+}
+
+func TestReconnectClientClose(t *testing.T) {
+	// a dial that hangs until it's stopped
+	rc := NewReconnectClient("tcp", "127.0.0.1:0")
+	rc.SetTimeout(time.Minute)
+	rc.dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := rc.Connect(ctx)
+	if err != ErrTimeout {
+		t.Fatal("expect timeout", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		rc.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked by the dial")
+	}
+}
+
+func TestReconnectClientRetry(t *testing.T) {
+	var err error
+	svc := NewService()
+
+	var calls int32
+	blocked := make(chan struct{}, 1)
+	err = svc.RegisterFunc("get", func(ctx context.Context) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 { // the first call is lost
+			blocked <- struct{}{}
+			<-ctx.Done()
+		}
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go svc.Serve(lis)
+	defer svc.Close()
+
+	rc := NewReconnectClient("tcp", lis.Addr().String())
+	rc.SetBackoff(time.Millisecond*10, time.Millisecond*50)
+	rc.MarkIdempotent("get")
+	defer rc.Close()
+
+	// retried on the next connection
+	var s string
+	errs := make(chan error, 1)
+	go func() {
+		errs <- rc.CallRemote("get", nil, &s)
+	}()
+	<-blocked
+	for _, r := range svc.Conns() {
+		r.Close()
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err.Error())
+	}
+	if s != "ok" || atomic.LoadInt32(&calls) != 2 {
+		t.Fatal("not retried", s, calls)
+	}
+}
+
+func TestRpcAuth(t *testing.T) {
+	serve := func(auth Authenticator, newCodec func(io.ReadWriteCloser) Codec) (*Service, string) {
+		svc := NewService()
+		svc.SetCodec(newCodec)
+		svc.SetAuthenticator(auth)
+		err := svc.RegisterFunc("whoami", func(ctx context.Context) (string, error) {
+			return PeerFromContext(ctx).Name, nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		go svc.Serve(lis)
+		return svc, lis.Addr().String()
+	}
+
+	cases := []struct {
+		server Authenticator
+		good   Authenticator
+		bad    Authenticator
+	}{
+		{
+			&TokenAuth{Tokens: map[string]string{"t1": "tom", "t2": "jerry"}},
+			&TokenAuth{Token: "t2"},
+			&TokenAuth{Token: "t3"},
+		},
+		{
+			&HMACAuth{Secrets: map[string][]byte{"jerry": []byte("s1")}},
+			&HMACAuth{Name: "jerry", Secret: []byte("s1")},
+			&HMACAuth{Name: "jerry", Secret: []byte("s2")},
+		},
+	}
+
+	for _, c := range cases {
+		svc, addr := serve(c.server, NewJsonCodec)
+
+		cliRpc, err := DialAuth("tcp", addr, c.good)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		err = callAndCheck(cliRpc, "whoami", nil, "jerry", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conns := svc.Conns()
+		if len(conns) != 1 || conns[0].Peer().Name != "jerry" {
+			t.Fatal("peer not match", conns)
+		}
+
+		_, err = DialAuth("tcp", addr, c.bad)
+		if err != ErrAuthFailed {
+			t.Fatal("expect auth failed", err)
+		}
+
+		// rejected before any request
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		noAuth := NewRpc(conn)
+		err = noAuth.Client.CallRemote("whoami", nil, nil)
+		if err == nil {
+			t.Fatal("expect error")
+		}
+
+		if n := len(svc.Conns()); n != 1 {
+			t.Fatal("expect 1 conn", n)
+		}
+		svc.Close()
+	}
+
+	// by gob
+	svc, addr := serve(cases[0].server, NewGobCodec)
+	defer svc.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cliRpc, err := NewRpcAuthWithCodec(conn, NewGobCodec, cases[0].good, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(cliRpc, "whoami", nil, "jerry", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRpcTLS(t *testing.T) {
+	var err error
+	ca, caKey := newTestCert(t, "ca", nil, nil)
+	svrCert, svrKey := newTestCert(t, "server", ca, caKey)
+	cliCert, cliKey := newTestCert(t, "alice", ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	keyPair := func(cert *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+		return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+	}
+
+	svc := NewService()
+	err = svc.RegisterFunc("whoami", func(ctx context.Context) ([]string, error) {
+		cert := PeerFromContext(ctx).Certificate
+		return append([]string{cert.Subject.CommonName}, cert.DNSNames...), nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go svc.ServeTLS(lis, &tls.Config{
+		Certificates: []tls.Certificate{keyPair(svrCert, svrKey)},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer svc.Close()
+
+	cliRpc, err := DialTLS("tcp", lis.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{keyPair(cliCert, cliKey)},
+		RootCAs:      pool,
+		ServerName:   "server",
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(cliRpc, "whoami", nil, []string{"alice", "alice", "alice.example.com"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if cliRpc.Peer() == nil || cliRpc.Peer().Name != "server" {
+		t.Fatal("server not verified", cliRpc.Peer())
+	}
+
+	// a client without certificate is rejected
+	bad, err := DialTLS("tcp", lis.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "server"})
+	if err == nil { // the server may fail it after the client is done with TLS 1.3
+		err = bad.Client.CallRemote("whoami", nil, nil)
+	}
+	if err == nil {
+		t.Fatal("expect error")
+	}
+
+	// by gob
+	gobLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer gobLis.Close()
+	accepted := make(chan *Rpc, 1)
+	go func() {
+		r, err := AcceptTLSWithCodec(gobLis, &tls.Config{
+			Certificates: []tls.Certificate{keyPair(svrCert, svrKey)},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		}, NewGobCodec)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- r
+	}()
+	gobRpc, err := DialTLSWithCodec("tcp", gobLis.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{keyPair(cliCert, cliKey)},
+		RootCAs:      pool,
+		ServerName:   "server",
+	}, NewGobCodec)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer gobRpc.Close()
+	svrRpc := <-accepted
+	if svrRpc == nil {
+		t.Fatal("accept failed")
+	}
+	defer svrRpc.Close()
+	err = svrRpc.Server.RegisterFunc("whoami", func(ctx context.Context) (string, error) {
+		return PeerFromContext(ctx).Name, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(gobRpc, "whoami", nil, "alice", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+// Make a certificate signed by parent, or a self-signed CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name, name + ".example.com"},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.DNSNames = nil
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return cert, key
+}
+
+// Token auth with the roles of peers.
+type testRoleAuth struct {
+	TokenAuth
+	roles map[string][]string
+}
+
+func (a *testRoleAuth) Authenticate(conn io.ReadWriter, server bool) (*Peer, error) {
+	peer, err := a.TokenAuth.Authenticate(conn, server)
+	if peer != nil {
+		peer.Roles = a.roles[peer.Name]
+	}
+	return peer, err
+}
+
+func TestRpcACL(t *testing.T) {
+	var err error
+	svc := NewService()
+	svc.SetAuthenticator(&testRoleAuth{
+		TokenAuth: TokenAuth{Tokens: map[string]string{"t1": "tom", "t2": "jerry"}},
+		roles:     map[string][]string{"jerry": {"admin"}},
+	})
+	err = svc.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svc.RegisterFunc("reset", func(n int) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	acl := NewACL()
+	acl.Allow("reset", "admin")
+	acl.Allow("*", "tom", "admin")
+	acl.Allow("Deliver", "*")
+	svc.SetACL(acl)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go svc.Serve(lis)
+	defer svc.Close()
+
+	tom, err := DialAuth("tcp", lis.Addr().String(), &TokenAuth{Token: "t1"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	jerry, err := DialAuth("tcp", lis.Addr().String(), &TokenAuth{Token: "t2"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	err = callAndCheck(tom, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(tom, "Deliver", []interface{}{fooType{}}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// denied before the params are decoded
+	err = callAndCheck(tom, "reset", []interface{}{"not int"}, nil, ErrPermissionDenied)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(jerry, "reset", []interface{}{1}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// reload
+	acl.Load(map[string][]string{"reset": {"tom"}, "*": {"*"}})
+	err = callAndCheck(tom, "reset", []interface{}{1}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(jerry, "reset", []interface{}{1}, nil, ErrPermissionDenied)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(jerry, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// denied without a rule of its own or of "*"
+	acl.Load(map[string][]string{"reset": {"tom"}})
+	err = callAndCheck(tom, "Echo", []interface{}{"abc"}, nil, ErrPermissionDenied)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(tom, "reset", []interface{}{1}, nil, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRpcRateLimit(t *testing.T) {
+	var err error
+	svc := NewService()
+	svc.SetAuthenticator(&TokenAuth{Tokens: map[string]string{"t1": "tom", "t2": "tom", "t3": "jerry"}})
+	err = svc.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = svc.RegisterFunc("Sum", func(a, b int) (int, error) {
+		return a + b, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	limiter := NewRateLimiter(LimitReject)
+	limiter.LimitPeer(0.01, 3)
+	limiter.LimitMethod("Sum", 0.01, 1)
+	svc.SetRateLimiter(limiter)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go svc.Serve(lis)
+	defer svc.Close()
+
+	dial := func(token string) *Rpc {
+		r, err := DialAuth("tcp", lis.Addr().String(), &TokenAuth{Token: token})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return r
+	}
+	tom1, tom2, jerry := dial("t1"), dial("t2"), dial("t3")
+
+	// the peer of both connections
+	for _, r := range []*Rpc{tom1, tom2, tom1} {
+		err = callAndCheck(r, "Echo", []interface{}{"abc"}, "abc", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = callAndCheck(tom2, "Echo", []interface{}{"abc"}, nil, ErrRateLimited)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the method of all peers
+	err = callAndCheck(jerry, "Sum", []interface{}{1, 2}, 3, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(jerry, "Sum", []interface{}{1, 2}, nil, ErrRateLimited)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(jerry, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// wait for the tokens of the connection
+	limiter = NewRateLimiter(LimitWait)
+	limiter.LimitConn(20, 1)
+	svc.SetRateLimiter(limiter)
+
+	r := dial("t3")
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err = callAndCheck(r, "Echo", []interface{}{"abc"}, "abc", nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*80 {
+		t.Fatal("not waited", elapsed)
+	}
+}
+
+func TestRpcBreaker(t *testing.T) {
+	var err error
+	cliRpc, svrRpc := newTestRpc(t)
+
+	err = svrRpc.Server.Register(&svrHandler{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var healthy, calls int32
+	err = svrRpc.Server.RegisterFunc("flaky", func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			panic("unhealthy")
+		}
+		return "ok", nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var lock sync.Mutex
+	var states []BreakerState
+	// the others are the default ones
+	b := NewBreaker(BreakerPolicy{
+		Failures: 2,
+		OpenTime: time.Millisecond * 50,
+	})
+	b.OnStateChange(func(method string, state BreakerState, err error) {
+		if method != "flaky" {
+			t.Error("unexpected method", method)
+		}
+		lock.Lock()
+		states = append(states, state)
+		lock.Unlock()
+	})
+	cliRpc.Client.Use(b.Intercept)
+
+	// open after failures in a row, a panic is an internal error
+	panicked := NewError(CodeInternalError, "Panic: unhealthy")
+	for i := 0; i < 2; i++ {
+		err = callAndCheck(cliRpc, "flaky", nil, nil, panicked)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	err = callAndCheck(cliRpc, "flaky", nil, nil, ErrCircuitOpen)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("not failed fast", n)
+	}
+	// other methods are not affected
+	err = callAndCheck(cliRpc, "Echo", []interface{}{"abc"}, "abc", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a failed trial opens it again
+	time.Sleep(time.Millisecond * 60)
+	if s := b.State("flaky"); s != BreakerHalfOpen {
+		t.Fatal("not half-open", s)
+	}
+	err = callAndCheck(cliRpc, "flaky", nil, nil, panicked)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = callAndCheck(cliRpc, "flaky", nil, nil, ErrCircuitOpen)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a succeeded trial closes it
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(time.Millisecond * 60)
+	err = callAndCheck(cliRpc, "flaky", nil, "ok", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := b.State("flaky"); s != BreakerClosed {
+		t.Fatal("not closed", s)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	expect := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if !reflect.DeepEqual(states, expect) {
+		t.Fatal("states not match", states)
+	}
+}
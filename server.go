@@ -1,109 +1,450 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
 )
 
+// Default number of requests handled concurrently on one connection.
+const DefaultMaxWorkers = 64
+
+// Default number of requests queued on one connection while all workers
+// are busy.
+const DefaultMaxQueue = 1024
+
+// Default number of requests in a batch at most.
+const DefaultMaxBatch = 1024
+
+// Shared by the Servers of all connections, unlimited by default.
+var globalWorkers = newSemaphore(0)
+
+// Limit the number of requests handled concurrently by all Servers.
+// n <= 0 means unlimited.
+func SetMaxWorkers(n int) {
+	globalWorkers.setMax(n)
+}
+
+// Handler handles a request and returns the result.
+type Handler func(ctx context.Context, req *Request) (result interface{}, err error)
+
+// Interceptor wraps the handling of requests. It calls next to go on, or
+// returns without calling it to short-circuit, e.g. with an *Error, which is
+// replied as is. It's called for notifications as well, whose results are
+// dropped, and for methods not found.
+type Interceptor func(ctx context.Context, req *Request, next Handler) (result interface{}, err error)
+
 type Server struct {
 	codec Codec
 
-	funcs map[string]reflect.Value
-	lock  sync.RWMutex
+	reg *registry
+
+	workers *workerPool
+
+	ctx    context.Context // canceled when the connection is closed
+	cancel context.CancelFunc
+
+	running  map[int64]context.CancelFunc // calls that can be canceled by id
+	streams  map[int64]*Stream            // opened streams by id
+	runningL sync.Mutex
+
+	batchParallel bool
+	maxBatch      int
+
+	shutdown bool
+	inflight sync.WaitGroup // of the requests being handled
+
+	client    *Client         // of the same Rpc, to call back
+	callbacks map[string]bool // names of the callbacks registered by client
+	callbackL sync.Mutex
+
+	bucket  *bucket // of the RateLimiter
+	bucketL sync.Mutex
 }
 
-func newServerWithCodec(codec Codec) *Server {
+func newServerWithCodec(codec Codec, shared *registry) *Server {
 	s := new(Server)
 	s.codec = codec
-	s.funcs = make(map[string]reflect.Value)
+	s.reg = newRegistry(shared)
+	s.workers = newWorkerPool(DefaultMaxWorkers, DefaultMaxQueue)
+	s.maxBatch = DefaultMaxBatch
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.running = make(map[int64]context.CancelFunc)
+	s.streams = make(map[int64]*Stream)
+	s.callbacks = make(map[string]bool)
 	return s
 }
 
+// Limit the number of requests handled concurrently on this connection.
+// n <= 0 means unlimited.
+func (s *Server) SetMaxWorkers(n int) {
+	s.workers.setMax(n)
+}
+
+// Limit the number of requests queued on this connection while all workers
+// are busy. A request is replied ErrServerBusy if the queue is full.
+// n <= 0 means no queue.
+func (s *Server) SetMaxQueue(n int) {
+	s.workers.setMaxQueue(n)
+}
+
+// Handle the requests of a batch in parallel or in order. They're in order
+// by default. In parallel, they're limited by the workers of the connection
+// as well.
+func (s *Server) SetBatchParallel(parallel bool) {
+	s.batchParallel = parallel
+}
+
+// Limit the number of requests in a batch. The requests of a larger batch
+// are replied ErrInvalidRequest. n <= 0 means unlimited.
+func (s *Server) SetMaxBatch(n int) {
+	s.maxBatch = n
+}
+
+// Add interceptors of all methods. They're called in the order added, the
+// first one is the outermost, before the interceptors of the method.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.reg.use("", interceptors)
+}
+
+// Add interceptors of method, which are called in the order added, after the
+// interceptors of all methods. The method needn't be registered yet.
+func (s *Server) UseMethod(method string, interceptors ...Interceptor) {
+	s.reg.use(method, interceptors)
+}
+
+// Set the only interceptors of method, in place of the ones of all methods
+// and the ones of UseMethod, including the ones of the Service. With none,
+// method is not intercepted, e.g. a health check exempted from the
+// interceptor of authorization.
+func (s *Server) SetMethodInterceptors(method string, interceptors ...Interceptor) {
+	s.reg.override(method, interceptors)
+}
+
+// Check the peer by acl before handling each request, or nil to allow all.
+// The requests denied are replied with ErrPermissionDenied, before the
+// interceptors and decoding the params.
+func (s *Server) SetACL(acl *ACL) {
+	s.reg.setACL(acl)
+}
+
+// Limit the requests by limiter after the ACL, or nil for no limit.
+func (s *Server) SetRateLimiter(limiter *RateLimiter) {
+	s.reg.setLimiter(limiter)
+}
+
+// The token bucket of the connection, full of limit.Burst at first.
+func (s *Server) connBucket(limit Limit) *bucket {
+	s.bucketL.Lock()
+	defer s.bucketL.Unlock()
+	if s.bucket == nil {
+		s.bucket = newBucket(limit)
+	}
+	return s.bucket
+}
+
 // Register all objects.Funcs to rpc
 func (s *Server) Register(object interface{}) (err error) {
-	t := reflect.TypeOf(object)
-	v := reflect.ValueOf(object)
+	return registerObject(object, s.RegisterFunc)
+}
 
-	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
-		return fmt.Errorf("'object' must be a point of struct")
+// Register a function to rpc. If the first param of f is a context.Context,
+// it's not read from the request but given the context of the request, which
+// is canceled when the connection is closed, or the caller has given up. Its
+// deadline is when the caller stops waiting.
+//
+// A func param of f is a callback to the caller, which is valid until f
+// returns. Its last output param must be an error.
+//
+// If f returns a channel and an error, like func(q Query) (<-chan Item, error),
+// the items received from the channel are streamed to the caller until it's
+// closed. f should stop sending once the context is done. If f takes a
+// *Stream, it's the stream opened by Client.OpenStream.
+func (s *Server) RegisterFunc(method string, f interface{}) (err error) {
+	if strings.HasPrefix(method, callbackPrefix) {
+		return fmt.Errorf("method name %v is reserved for callbacks", method)
+	}
+	return s.register(method, f)
+}
+
+func (s *Server) register(method string, f interface{}) (err error) {
+	err = checkFunc(method, f)
+	if err != nil {
+		return err
 	}
 
-	var count int
-	for i := 0; i < t.NumMethod(); i++ {
-		mt := t.Method(i)
-		mv := v.Method(i)
+	// register type
+	err = codecRegisterFuncTypes(s.codec, f)
+	if err != nil {
+		return err
+	}
 
-		// find a public method
-		if mt.PkgPath != "" || !mv.CanInterface() {
-			continue
-		}
+	// register
+	return s.reg.register(method, reflect.ValueOf(f))
+}
 
-		// register
-		err := s.RegisterFunc(mt.Name, mv.Interface())
-		if err != nil {
-			return err
+// Register f as a callback of a call of the client.
+func (s *Server) registerCallback(name string, f interface{}) error {
+	err := s.register(name, f)
+	if err != nil {
+		return err
+	}
+	s.callbackL.Lock()
+	s.callbacks[name] = true
+	s.callbackL.Unlock()
+	return nil
+}
+
+func (s *Server) unregisterCallback(name string) {
+	s.callbackL.Lock()
+	delete(s.callbacks, name)
+	s.callbackL.Unlock()
+	s.reg.unregister(name)
+}
+
+// Whether method is a callback registered by the client. It's not limited by
+// the workers, the ACL or the RateLimiter, since it's called by a request
+// that's been through them.
+func (s *Server) isCallback(method string) bool {
+	s.callbackL.Lock()
+	defer s.callbackL.Unlock()
+	return s.callbacks[method]
+}
+
+// Dispatch the request to a worker, or queue it while all workers are busy.
+// It never blocks, so that the responses, cancels and stream frames are
+// read meanwhile. Callbacks are not limited, since they're called by the
+// requests being handled.
+func (s *Server) onRequest(req *Request) error {
+	switch req.kind {
+	case kindCancel:
+		s.cancelRequest(req.Id)
+		return nil
+	case kindAck, kindSend, kindEnd:
+		s.onStream(req)
+		return nil
+	}
+
+	reqs := []*Request{req}
+	if req.kind == kindBatch {
+		reqs = req.batch
+	}
+	if req.kind == kindBatch && len(reqs) == 0 { // a single reply, as in JSON-RPC 2.0
+		return s.codec.WriteResponse(&Response{Error: ErrInvalidRequest})
+	}
+	if req.kind == kindBatch && s.maxBatch > 0 && len(reqs) > s.maxBatch {
+		return s.reject(req, reqs, ErrInvalidRequest)
+	}
+
+	// callbacks are served even while shutting down, until the calls of the
+	// client are done
+	callback := req.kind != kindBatch && s.isCallback(req.Method)
+	if !callback {
+		s.runningL.Lock()
+		if s.shutdown {
+			s.runningL.Unlock()
+			return s.reject(req, reqs, ErrShuttingDown)
 		}
+		s.inflight.Add(1)
+		s.runningL.Unlock()
+	}
 
-		count += 1
+	ctxs := make([]context.Context, len(reqs))
+	cancels := make([]context.CancelFunc, len(reqs))
+	for i, r := range reqs {
+		ctxs[i], cancels[i] = s.begin(r)
 	}
 
-	if count <= 0 {
-		return fmt.Errorf("Register object has no method")
+	done := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		if !callback {
+			s.inflight.Done()
+		}
+	}
+
+	parallel := req.kind == kindBatch && s.batchParallel
+	job := func() {
+		if !callback && !parallel { // each request of a parallel batch waits for its own
+			globalWorkers.acquire()
+			defer globalWorkers.release()
+		}
+		defer done()
+
+		if req.kind == kindBatch {
+			s.serveBatch(ctxs, reqs, parallel)
+		} else {
+			s.serve(ctxs[0], req)
+		}
 	}
 
+	if callback {
+		go job()
+		return nil
+	}
+	if !s.workers.submit(job) {
+		for _, r := range reqs {
+			s.end(r)
+		}
+		done()
+		return s.reject(req, reqs, ErrServerBusy)
+	}
 	return nil
 }
 
-// Register a function to rpc
-func (s *Server) RegisterFunc(method string, f interface{}) (err error) {
-	if method == "" {
-		return fmt.Errorf("method name is empty")
+// Reply an error to the requests without handling them.
+func (s *Server) reject(req *Request, reqs []*Request, e *Error) error {
+	var batch []*Response
+	for _, r := range reqs {
+		if r.Id != 0 {
+			batch = append(batch, &Response{Id: r.Id, Error: e})
+		}
 	}
-	if f == nil {
-		return fmt.Errorf("func is nil")
+
+	if len(batch) == 0 {
+		return nil
+	}
+	if req.kind == kindBatch {
+		return s.codec.WriteResponse(&Response{kind: kindBatch, batch: batch})
 	}
+	return s.codec.WriteResponse(batch[0])
+}
 
-	v := reflect.ValueOf(f)
-	t := reflect.TypeOf(f)
+// Refuse new requests, and wait for the requests being handled to reply.
+func (s *Server) drain(ctx context.Context) error {
+	s.runningL.Lock()
+	s.shutdown = true
+	s.runningL.Unlock()
 
-	// f must be a Func
-	if t.Kind() != reflect.Func {
-		return fmt.Errorf("'%v' is not a function", method)
+	return waitContext(ctx, &s.inflight)
+}
+
+// Make the context of the request, which can be canceled by id. It carries
+// the request for its headers, and the trailers to reply. Its deadline is
+// when the caller stops waiting, counted from now.
+func (s *Server) begin(req *Request) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if req.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, req.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
 	}
+	ctx = context.WithValue(ctx, requestKey{}, req)
+	ctx = context.WithValue(ctx, replyKey{}, new(trailer))
 
-	// f must return error as last param
-	nOut := t.NumOut()
-	if nOut == 0 || t.Out(nOut-1).Kind() != reflect.Interface {
-		err = fmt.Errorf("must return error as the last output param")
-		return
+	if req.Id != 0 { // a notification can't be canceled
+		s.runningL.Lock()
+		s.running[req.Id] = cancel
+		s.runningL.Unlock()
 	}
-	_, b := t.Out(nOut - 1).MethodByName("Error")
-	if !b {
-		err = fmt.Errorf("must return error as the last output param")
-		return
+	return ctx, cancel
+}
+
+// Whether the request has been canceled by the caller.
+func (s *Server) end(req *Request) (canceled bool) {
+	s.runningL.Lock()
+	_, ok := s.running[req.Id]
+	delete(s.running, req.Id)
+	s.runningL.Unlock()
+	return !ok
+}
+
+// The caller has given up the call, stop the handler and never reply.
+func (s *Server) cancelRequest(id int64) {
+	s.runningL.Lock()
+	cancel, ok := s.running[id]
+	delete(s.running, id)
+	s.runningL.Unlock()
+
+	if ok {
+		cancel()
 	}
+}
 
-	// register type
-	err = codecRegisterFuncTypes(s.codec, f)
-	if err != nil {
-		return err
+func (s *Server) serve(ctx context.Context, req *Request) error {
+	resp := s.reply(ctx, req)
+	if resp == nil {
+		return nil
 	}
+	return s.codec.WriteResponse(resp) // encode and write
+}
 
-	// register
-	s.lock.Lock()
-	if _, ok := s.funcs[method]; ok {
-		err = fmt.Errorf("method has been registered")
-		s.lock.Unlock()
-		return
+// Handle the requests of a batch and reply them in one frame. In parallel, at
+// most as many as the workers of the connection are handled at once, and each
+// waits for the global limit.
+func (s *Server) serveBatch(ctxs []context.Context, reqs []*Request, parallel bool) error {
+	resps := make([]*Response, len(reqs))
+
+	if parallel {
+		n := s.workers.size()
+		if n <= 0 || n > len(reqs) {
+			n = len(reqs)
+		}
+		sem := make(chan struct{}, n)
+		var wg sync.WaitGroup
+		for i := range reqs {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				globalWorkers.acquire()
+				defer globalWorkers.release()
+				resps[i] = s.reply(ctxs[i], reqs[i])
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range reqs {
+			resps[i] = s.reply(ctxs[i], reqs[i])
+		}
 	}
-	s.funcs[method] = v
-	s.lock.Unlock()
-	return
+
+	var batch []*Response
+	for _, resp := range resps {
+		if resp != nil {
+			batch = append(batch, resp)
+		}
+	}
+
+	if len(batch) == 0 { // all notifications
+		return nil
+	}
+	return s.codec.WriteResponse(&Response{kind: kindBatch, batch: batch})
 }
 
-func (s *Server) onRequest(req *Request) (err error) {
-	result, err := s.handle(req)
+// Handle the request and make the response, or nil if no reply is needed.
+func (s *Server) reply(ctx context.Context, req *Request) *Response {
+	if req.kind == kindInvalid { // without id, as in JSON-RPC 2.0
+		return &Response{Error: ErrInvalidRequest}
+	}
+
+	var result interface{}
+	var err error
+	if err = ctx.Err(); err == nil { // not canceled or expired while waiting for a worker
+		result, err = s.handle(ctx, req)
+	}
+	if err == context.DeadlineExceeded {
+		err = ErrDeadline
+	}
+
+	if req.Id == 0 { // notification, never reply
+		return nil
+	}
+
+	if err == nil && result != nil && reflect.TypeOf(result).Kind() == reflect.Chan {
+		err = s.stream(ctx, req, reflect.ValueOf(result))
+		result = nil
+	}
+
+	if s.end(req) {
+		return nil
+	}
+
 	e, ok := err.(*Error)
 	if !ok {
 		if err != nil {
@@ -112,66 +453,229 @@ func (s *Server) onRequest(req *Request) (err error) {
 			e = nil
 		}
 	}
-	return s.codec.WriteResponse(req.Id, result, e) // encode and write
+	var header Header
+	if t, ok := ctx.Value(replyKey{}).(*trailer); ok {
+		header = t.header()
+	}
+	return &Response{Id: req.Id, Error: e, Header: header, result: result}
+}
+
+// Send the items received from ch to the caller, until ch is closed. The
+// response of the request follows to end the stream.
+func (s *Server) stream(ctx context.Context, req *Request, ch reflect.Value) error {
+	st, err := s.openStream(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer s.closeStream(st)
+
+	if ch.IsNil() {
+		return nil
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: ch},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+
+	for {
+		chosen, v, ok := reflect.Select(cases)
+		if chosen == 1 {
+			return ctx.Err()
+		}
+		if !ok { // closed
+			return nil
+		}
+
+		err = st.Send(v.Interface())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Open the stream of the request, and tell the caller.
+func (s *Server) openStream(ctx context.Context, req *Request) (*Stream, error) {
+	if req.Id == 0 {
+		return nil, fmt.Errorf("notification can't stream")
+	}
+
+	st := newStream(ctx, s.codec, req.Id)
+
+	s.runningL.Lock()
+	s.streams[req.Id] = st
+	s.runningL.Unlock()
+
+	err := s.codec.WriteResponse(&Response{Id: req.Id, kind: kindOpen})
+	if err != nil {
+		s.closeStream(st)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Server) closeStream(st *Stream) {
+	s.runningL.Lock()
+	delete(s.streams, st.id)
+	s.runningL.Unlock()
+
+	close(st.done)
+}
+
+// Frames of the stream from the caller.
+func (s *Server) onStream(req *Request) {
+	s.runningL.Lock()
+	st, ok := s.streams[req.Id]
+	s.runningL.Unlock()
+
+	if !ok {
+		return
+	}
+
+	switch req.kind {
+	case kindAck:
+		var n int
+		if req.Param(0, &n) == nil {
+			st.addCredits(n)
+		}
+	case kindSend:
+		if req.Len() > 0 {
+			st.push(req.params[0])
+		}
+	case kindEnd:
+		st.end()
+	}
 }
 
-func (s *Server) handle(req *Request) (result interface{}, err error) {
+func (s *Server) handle(ctx context.Context, req *Request) (result interface{}, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			if e, ok := r.(error); ok {
+			if e, ok := r.(*Error); ok {
 				err = e
 			} else {
-				err = fmt.Errorf("Panic: %v", r)
+				err = NewError(CodeInternalError, fmt.Sprintf("Panic: %v", r))
 			}
 		}
 	}()
 
+	if !s.isCallback(req.Method) {
+		if acl := s.reg.getACL(); acl != nil && !acl.Allowed(PeerFromContext(ctx), req.Method) {
+			return nil, ErrPermissionDenied
+		}
+		if limiter := s.reg.getLimiter(); limiter != nil {
+			if err := limiter.take(ctx, s, req.Method); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	h := Handler(s.call)
+	ics := s.reg.chain(req.Method)
+	for i := len(ics) - 1; i >= 0; i-- {
+		ic, next := ics[i], h
+		h = func(ctx context.Context, req *Request) (interface{}, error) {
+			return ic(ctx, req, next)
+		}
+	}
+	return h(ctx, req)
+}
+
+// Call the func of the method.
+func (s *Server) call(ctx context.Context, req *Request) (result interface{}, err error) {
 	method := req.Method
 
-	s.lock.RLock()
-	f, ok := s.funcs[method]
-	s.lock.RUnlock()
+	f, ok := s.reg.lookup(method)
 
 	if !ok {
 		return nil, ErrMethodNotFound
 	}
 
-	inValues, err := s.buildInValues(f, req)
+	inValues, st, err := s.buildInValues(ctx, f, req)
 	if err != nil {
 		return nil, ErrInvalidParams
 	}
+	if st != nil {
+		defer s.closeStream(st)
+	}
 
 	outs := f.Call(inValues)
 
 	return s.returnResult(outs)
 }
 
-func (s *Server) buildInValues(fv reflect.Value, req *Request) (inValues []reflect.Value, err error) {
+// Params of context.Context and *Stream are not read from the request.
+func (s *Server) buildInValues(ctx context.Context, fv reflect.Value, req *Request) (inValues []reflect.Value, st *Stream, err error) {
 	f := fv.Type()
 	numIn := f.NumIn()
-	if numIn != req.Len() {
-		return nil, fmt.Errorf("params len=%v error! need %v", req.Len(), numIn)
+
+	var numParams int
+	var streamAt = -1
+	for i := 0; i < numIn; i++ {
+		switch f.In(i) {
+		case typeOfContext:
+		case typeOfStream:
+			streamAt = i
+		default:
+			numParams += 1
+		}
+	}
+
+	if numParams != req.Len() {
+		return nil, nil, fmt.Errorf("params len=%v error! need %v", req.Len(), numParams)
 	}
 
 	inValues = make([]reflect.Value, numIn)
+	var j int
 	for i := 0; i < numIn; i++ {
-		param := req.params[i]
+		switch f.In(i) {
+		case typeOfContext:
+			inValues[i] = reflect.ValueOf(ctx)
+			continue
+		case typeOfStream:
+			continue
+		}
 
-		if param == nil {
+		param := req.params[j]
+
+		if param != nil && f.In(i).Kind() == reflect.Func {
+			var name string
+			err = req.Param(j, &name)
+			if err != nil {
+				return nil, nil, err
+			}
+			if name == "" { // null of JSON
+				inValues[i] = reflect.Zero(f.In(i))
+			} else {
+				inValues[i], err = s.makeCallback(f.In(i), name)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		} else if param == nil {
 			inValues[i] = reflect.Zero(f.In(i))
 		} else {
 			pv := reflect.New(f.In(i))
 			v := pv.Interface()
-			err = req.Param(i, v)
+			err = req.Param(j, v)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 
 			inValues[i] = reflect.ValueOf(pv.Elem().Interface())
 		}
+		j += 1
+	}
+
+	// open the stream once the params are fine
+	if streamAt >= 0 {
+		st, err = s.openStream(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		inValues[streamAt] = reflect.ValueOf(st)
 	}
 
-	return inValues, nil
+	return inValues, st, nil
 }
 
 func (s *Server) returnResult(outs []reflect.Value) (result interface{}, err error) {
@@ -202,3 +706,120 @@ func (s *Server) returnResult(outs []reflect.Value) (result interface{}, err err
 	}
 	return results, nil
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// workerPool runs the jobs by at most max workers, and queues at most
+// maxQueue jobs while they're all busy, which are run by the workers in
+// order.
+type workerPool struct {
+	lock     sync.Mutex
+	max      int
+	maxQueue int
+	busy     int
+	queue    []func()
+}
+
+func newWorkerPool(max, maxQueue int) *workerPool {
+	p := new(workerPool)
+	p.max = max
+	p.maxQueue = maxQueue
+	return p
+}
+
+// Run job by a worker, or queue it. It returns false if the queue is full.
+func (p *workerPool) submit(job func()) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.max <= 0 || p.busy < p.max {
+		p.busy += 1
+		go p.work(job)
+		return true
+	}
+	if len(p.queue) >= p.maxQueue {
+		return false
+	}
+	p.queue = append(p.queue, job)
+	return true
+}
+
+// Run job, then the queued ones until the queue is empty.
+func (p *workerPool) work(job func()) {
+	for job != nil {
+		job()
+
+		p.lock.Lock()
+		job = nil
+		if len(p.queue) > 0 && (p.max <= 0 || p.busy <= p.max) {
+			job = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+		} else {
+			p.busy -= 1
+		}
+		p.lock.Unlock()
+	}
+}
+
+func (p *workerPool) setMax(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.max = n
+	for len(p.queue) > 0 && (p.max <= 0 || p.busy < p.max) {
+		p.busy += 1
+		go p.work(p.queue[0])
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+	}
+}
+
+// The number of workers at most, <= 0 if unlimited.
+func (p *workerPool) size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.max
+}
+
+func (p *workerPool) setMaxQueue(n int) {
+	p.lock.Lock()
+	p.maxQueue = n
+	p.lock.Unlock()
+}
+
+// semaphore limits the jobs run concurrently, by blocking the ones over max.
+type semaphore struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	max  int
+	busy int
+}
+
+func newSemaphore(max int) *semaphore {
+	p := new(semaphore)
+	p.cond = sync.NewCond(&p.lock)
+	p.max = max
+	return p
+}
+
+func (p *semaphore) acquire() {
+	p.lock.Lock()
+	for p.max > 0 && p.busy >= p.max {
+		p.cond.Wait()
+	}
+	p.busy += 1
+	p.lock.Unlock()
+}
+
+func (p *semaphore) release() {
+	p.lock.Lock()
+	p.busy -= 1
+	p.cond.Signal()
+	p.lock.Unlock()
+}
+
+func (p *semaphore) setMax(n int) {
+	p.lock.Lock()
+	p.max = n
+	p.cond.Broadcast()
+	p.lock.Unlock()
+}
@@ -0,0 +1,257 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Service serves the same methods on many connections. The methods are
+// registered once and shared by the Servers of all connections, while a
+// method registered to the Server of one connection is only served on it.
+type Service struct {
+	reg      *registry
+	newCodec func(conn io.ReadWriteCloser) Codec
+	onConn   func(r *Rpc)
+	auth     Authenticator
+
+	conns     map[*Rpc]struct{}
+	listeners map[net.Listener]struct{}
+	closed    bool
+	lock      sync.Mutex
+	wg        sync.WaitGroup // of the connections
+}
+
+func NewService() *Service {
+	s := new(Service)
+	s.reg = newRegistry(nil)
+	s.newCodec = NewJsonCodec
+	s.conns = make(map[*Rpc]struct{})
+	s.listeners = make(map[net.Listener]struct{})
+	return s
+}
+
+// Set how connections are encoded. It's NewJsonCodec by default.
+func (s *Service) SetCodec(newCodec func(conn io.ReadWriteCloser) Codec) {
+	s.newCodec = newCodec
+}
+
+// Authenticate each new connection by auth before it's served. The ones
+// failing are closed.
+func (s *Service) SetAuthenticator(auth Authenticator) {
+	s.auth = auth
+}
+
+// Called with the Rpc of each new connection before it's served, e.g. to set
+// the workers of the connection.
+func (s *Service) OnConnect(f func(r *Rpc)) {
+	s.onConn = f
+}
+
+// Add interceptors of all methods on all connections, as Server.Use. They're
+// called before the ones added to the Server of a connection.
+func (s *Service) Use(interceptors ...Interceptor) {
+	s.reg.use("", interceptors)
+}
+
+// Add interceptors of method on all connections, as Server.UseMethod.
+func (s *Service) UseMethod(method string, interceptors ...Interceptor) {
+	s.reg.use(method, interceptors)
+}
+
+// Set the only interceptors of method on all connections, as
+// Server.SetMethodInterceptors. The ones set to the Server of a connection
+// take their place.
+func (s *Service) SetMethodInterceptors(method string, interceptors ...Interceptor) {
+	s.reg.override(method, interceptors)
+}
+
+// Check the peers of all connections by acl, as Server.SetACL. The ACL set
+// to the Server of a connection takes its place.
+func (s *Service) SetACL(acl *ACL) {
+	s.reg.setACL(acl)
+}
+
+// Limit the requests of all connections by limiter, as Server.SetRateLimiter.
+// The RateLimiter set to the Server of a connection takes its place.
+func (s *Service) SetRateLimiter(limiter *RateLimiter) {
+	s.reg.setLimiter(limiter)
+}
+
+// Register all objects.Funcs to all connections.
+func (s *Service) Register(object interface{}) error {
+	return registerObject(object, s.RegisterFunc)
+}
+
+// Register a function to all connections, as Server.RegisterFunc.
+func (s *Service) RegisterFunc(method string, f interface{}) error {
+	if strings.HasPrefix(method, callbackPrefix) {
+		return fmt.Errorf("method name %v is reserved for callbacks", method)
+	}
+	err := checkFunc(method, f)
+	if err != nil {
+		return err
+	}
+
+	err = s.reg.register(method, reflect.ValueOf(f))
+	if err != nil {
+		return err
+	}
+
+	// register type to the connections served already
+	for _, r := range s.Conns() {
+		err = codecRegisterFuncTypes(r.codec, f)
+		if err != nil {
+			s.reg.unregister(method)
+			return err
+		}
+	}
+	return nil
+}
+
+// Accept connections from l and serve them until l is closed. It returns
+// ErrServiceClosed once the Service is shut down or closed.
+func (s *Service) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrServiceClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		delete(s.listeners, l)
+		s.lock.Unlock()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServiceClosed
+			}
+			return err
+		}
+
+		go s.ServeConn(conn) // the handshake may take a while
+	}
+}
+
+// Serve as Serve on TLS connections of l.
+func (s *Service) ServeTLS(l net.Listener, config *tls.Config) error {
+	return s.Serve(tls.NewListener(l, config))
+}
+
+// Serve one connection, once it's authenticated if there's an Authenticator,
+// and the TLS handshake is done if it's a *tls.Conn. The Rpc is tracked until
+// the connection is ended.
+func (s *Service) ServeConn(conn io.ReadWriteCloser) (*Rpc, error) {
+	peer, err := handshake(conn, s.auth, true)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := s.newCodec(conn)
+	for _, f := range s.reg.all() {
+		err = codecRegisterFuncTypes(codec, f.Interface())
+		if err != nil {
+			codec.Close()
+			return nil, err
+		}
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		codec.Close()
+		return nil, ErrServiceClosed
+	}
+	r := newRpc(codec, s.reg)
+	if peer != nil {
+		r.setPeer(peer)
+	}
+	s.conns[r] = struct{}{}
+	s.wg.Add(1)
+	s.lock.Unlock()
+
+	if s.onConn != nil {
+		s.onConn(r)
+	}
+	go r.run()
+
+	go func() {
+		<-r.Done()
+		s.lock.Lock()
+		delete(s.conns, r)
+		s.lock.Unlock()
+		s.wg.Done()
+	}()
+	return r, nil
+}
+
+// The Rpcs of the connections being served.
+func (s *Service) Conns() []*Rpc {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conns := make([]*Rpc, 0, len(s.conns))
+	for r := range s.conns {
+		conns = append(conns, r)
+	}
+	return conns
+}
+
+// Stop accepting connections, and shut down all connections as Rpc.Shutdown.
+// It returns the first error of them.
+func (s *Service) Shutdown(ctx context.Context) error {
+	conns := s.stop()
+
+	errs := make(chan error, len(conns))
+	for _, r := range conns {
+		go func(r *Rpc) {
+			errs <- r.Shutdown(ctx)
+		}(r)
+	}
+
+	var err error
+	for range conns {
+		if e := <-errs; err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return waitContext(ctx, &s.wg)
+}
+
+// Stop accepting connections, and close all connections.
+func (s *Service) Close() error {
+	for _, r := range s.stop() {
+		r.Close()
+	}
+	return nil
+}
+
+// Close the listeners, and return the connections being served.
+func (s *Service) stop() []*Rpc {
+	s.lock.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.lock.Unlock()
+	return s.Conns()
+}
+
+func (s *Service) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
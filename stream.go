@@ -0,0 +1,248 @@
+package rpc
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sync"
+)
+
+var typeOfStream = reflect.TypeOf((*Stream)(nil))
+
+// Stream is a stream of items in both directions of a call, multiplexed on
+// the connection by the request id. The caller opens it by Client.OpenStream,
+// and the handler takes it as a param, e.g. func(s *Stream) (Summary, error).
+// With GobCodec, the types of the items must be registered by Rpc.RegisterType
+// on the side receiving them.
+//
+// Recv returns io.EOF once the other side has done sending, which is when the
+// caller calls CloseSend, or the handler returns. Each side never sends more
+// than a window of items ahead of the other side taking them.
+type Stream struct {
+	id    int64
+	codec Codec
+	ctx   context.Context
+	call  *Call // of the caller side, nil on the handler side
+
+	items   chan interface{} // received but not taken
+	credits chan struct{}    // one for each item to send
+	done    chan struct{}    // closed when the call is over
+	final   *Response        // of the call, on the caller side
+
+	lock   sync.Mutex
+	taken  int
+	ended  bool // the other side has done sending
+	opened bool
+
+	closed bool                  // done sending
+	types  map[reflect.Type]bool // of the items sent, registered to the codec
+	sendL  sync.Mutex
+}
+
+func newStream(ctx context.Context, codec Codec, id int64) *Stream {
+	st := new(Stream)
+	st.id = id
+	st.codec = codec
+	st.ctx = ctx
+	st.items = make(chan interface{}, streamWindow)
+	st.credits = make(chan struct{}, streamWindow)
+	st.done = make(chan struct{})
+	for i := 0; i < streamWindow; i++ {
+		st.credits <- struct{}{}
+	}
+	return st
+}
+
+// Context of the stream, which is done if the call is canceled.
+func (st *Stream) Context() context.Context {
+	return st.ctx
+}
+
+// Send an item. It blocks while a window of items are not taken by the other
+// side yet. The type of the item is registered to the codec, while the other
+// side may need Rpc.RegisterType to receive it.
+func (st *Stream) Send(v interface{}) error {
+	select {
+	case <-st.credits:
+	case <-st.done:
+		return ErrStreamClosed
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+
+	st.sendL.Lock()
+	defer st.sendL.Unlock()
+	if st.closed {
+		return ErrStreamClosed
+	}
+	st.registerType(v)
+
+	if st.call != nil {
+		return st.codec.WriteRequest(&Request{Id: st.id, kind: kindSend, params: []interface{}{v}})
+	}
+	return st.codec.WriteResponse(&Response{Id: st.id, kind: kindItem, result: v})
+}
+
+// Register the type of an item to the codec once. If it fails, e.g. the type
+// is registered by another name already, writing the item tells whether it's
+// a problem.
+func (st *Stream) registerType(v interface{}) {
+	t := reflect.TypeOf(v)
+	if t == nil || st.types[t] {
+		return
+	}
+	if st.types == nil {
+		st.types = make(map[reflect.Type]bool)
+	}
+	st.types[t] = true
+
+	defer func() {
+		recover()
+	}()
+	st.codec.RegisterType(v)
+}
+
+// Receive an item into pv. It returns io.EOF once the other side has done
+// sending, or the error of the call if it failed.
+func (st *Stream) Recv(pv interface{}) error {
+	var data interface{}
+	var ok bool
+	select {
+	case data, ok = <-st.items:
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+
+	if !ok {
+		if st.call != nil && st.call.Error != nil {
+			return st.call.Error
+		}
+		return io.EOF
+	}
+
+	err := st.ack()
+	if err != nil {
+		return err
+	}
+	return st.codec.Unmarshal(data, pv)
+}
+
+// Tell the handler that the caller has done sending. The handler is done
+// sending once it returns.
+func (st *Stream) CloseSend() error {
+	if st.call == nil {
+		return nil
+	}
+
+	st.sendL.Lock()
+	defer st.sendL.Unlock()
+	if st.closed {
+		return nil
+	}
+	st.closed = true
+
+	return st.codec.WriteRequest(&Request{Id: st.id, kind: kindEnd})
+}
+
+// Wait for the handler to return, and decode its result into pv if it's not
+// nil. It's only for the caller side.
+func (st *Stream) Wait(pv interface{}) error {
+	if st.call == nil {
+		return nil
+	}
+
+	select {
+	case <-st.done:
+	case <-st.ctx.Done():
+		return st.ctx.Err()
+	}
+
+	if st.call.Error != nil {
+		return st.call.Error
+	}
+
+	st.lock.Lock()
+	final := st.final
+	st.lock.Unlock()
+
+	if pv != nil && final != nil {
+		return final.Result(pv)
+	}
+	return nil
+}
+
+// Tell the other side as items are taken, a half window at a time.
+func (st *Stream) ack() error {
+	st.lock.Lock()
+	st.taken += 1
+	n := st.taken
+	if n < streamWindow/2 {
+		st.lock.Unlock()
+		return nil
+	}
+	st.taken = 0
+	st.lock.Unlock()
+
+	if st.call != nil {
+		return st.codec.WriteRequest(&Request{Id: st.id, kind: kindAck, params: []interface{}{n}})
+	}
+	return st.codec.WriteResponse(&Response{Id: st.id, kind: kindAckSend, result: n})
+}
+
+// The following never block Rpc.run.
+
+func (st *Stream) open() {
+	st.lock.Lock()
+	st.opened = true
+	st.lock.Unlock()
+}
+
+func (st *Stream) isOpened() bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	return st.opened
+}
+
+func (st *Stream) push(data interface{}) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.ended {
+		return
+	}
+	select {
+	case st.items <- data:
+	default:
+		// the other side sent more than the window
+	}
+}
+
+func (st *Stream) addCredits(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case st.credits <- struct{}{}:
+		default: // more than sent
+			return
+		}
+	}
+}
+
+// The other side has done sending.
+func (st *Stream) end() {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if !st.ended {
+		st.ended = true
+		close(st.items)
+	}
+}
+
+// The call is over, final is the response, or nil if it failed locally.
+// Only once for a call.
+func (st *Stream) finish(final *Response) {
+	st.lock.Lock()
+	st.final = final
+	st.lock.Unlock()
+
+	st.end()
+	close(st.done)
+}
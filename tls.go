@@ -0,0 +1,46 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+)
+
+// Dial a TLS connection. The peer of the Rpc is the server, whose certificate
+// is verified by config.
+func DialTLS(network, address string, config *tls.Config) (*Rpc, error) {
+	return DialTLSWithCodec(network, address, config, NewJsonCodec)
+}
+
+// Same as DialTLS, but encoded by the codec of newCodec.
+func DialTLSWithCodec(network, address string, config *tls.Config, newCodec func(conn io.ReadWriteCloser) Codec) (*Rpc, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewRpcAuthWithCodec(conn, newCodec, nil, false)
+}
+
+// Accept a TLS connection. For mutual TLS, config.ClientAuth should be
+// tls.RequireAndVerifyClientCert, and the peer of the Rpc is the client.
+func AcceptTLS(l net.Listener, config *tls.Config) (*Rpc, error) {
+	return AcceptTLSWithCodec(l, config, NewJsonCodec)
+}
+
+// Same as AcceptTLS, but encoded by the codec of newCodec.
+func AcceptTLSWithCodec(l net.Listener, config *tls.Config, newCodec func(conn io.ReadWriteCloser) Codec) (*Rpc, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewRpcAuthWithCodec(tls.Server(conn, config), newCodec, nil, true)
+}
+
+// The peer of the verified certificate, or nil if it's not verified.
+func tlsPeer(state tls.ConnectionState) *Peer {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := state.VerifiedChains[0][0]
+	return &Peer{Name: cert.Subject.CommonName, Certificate: cert}
+}